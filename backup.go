@@ -0,0 +1,327 @@
+package peach
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	ErrDirNotEmpty       = errors.New("directory is not empty")
+	ErrNotBackup         = errors.New("not a backup")
+	ErrBrokenBackupChain = errors.New("broken backup chain")
+)
+
+type (
+	// backupInfo is saved in the manifest of a backup. State is the extent of
+	// every log file when the backup was taken, which is the high-water mark
+	// of the next incremental backup, and Segments are the parts of the log
+	// files stored in the backup: the file log.N of the backup holds the bytes
+	// of the log file N from Offset to End.
+	backupInfo struct {
+		ID       int64        `json:"id"`
+		Parent   int64        `json:"parent,omitempty"`
+		State    []fileExtent `json:"state"`
+		Segments []fileExtent `json:"segments"`
+	}
+
+	// fileExtent is a range of a log file, which is told apart from a file of
+	// the same id rewritten by a merge or a repair by the creation time of its
+	// header, in nanoseconds. A file without header is never rewritten as
+	// such, its creation time is 0.
+	fileExtent struct {
+		FID       int   `json:"fid"`
+		CreatedAt int64 `json:"created_at"`
+		Offset    int64 `json:"offset"`
+		End       int64 `json:"end"`
+	}
+)
+
+// Backup copies the log files of db into dir, which must be empty or not
+// exist, along with a manifest listing them. The active log file is sealed
+// first and merges wait for the backup, writes go on meanwhile. The log files
+// are hard-linked when possible, they are never written once sealed.
+func (db *DB) Backup(dir string) error {
+	return db.backup(dir, nil, true)
+}
+
+// BackupSince copies into dir what changed since the backup whose manifest
+// is lastBackupManifest: the log files created or rewritten by a merge since
+// then and the bytes appended to the others, the active log file included.
+// The backups are restored with RestoreChain.
+func (db *DB) BackupSince(dir, lastBackupManifest string) error {
+	last, err := readManifestFile(lastBackupManifest)
+	if err != nil {
+		return err
+	}
+	if last.Backup == nil {
+		return ErrNotBackup
+	}
+
+	return db.backup(dir, last.Backup, false)
+}
+
+func (db *DB) backup(dir string, last *backupInfo, seal bool) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := prepareDir(dir); err != nil {
+		return err
+	}
+
+	// the log files must not be replaced by a merge while they are copied
+	db.gcMu.Lock()
+	defer db.gcMu.Unlock()
+
+	state, active, err := db.backupState(seal)
+	if err != nil {
+		return err
+	}
+
+	info := &backupInfo{ID: time.Now().UnixNano(), State: state}
+	if last != nil {
+		info.Parent = last.ID
+	}
+
+	files := make([]int, 0, len(state))
+	for _, fe := range state {
+		files = append(files, fe.FID)
+
+		seg := fe
+		if prev, ok := findExtent(last, fe.FID); ok && prev.CreatedAt == fe.CreatedAt && prev.End <= fe.End {
+			seg.Offset = prev.End
+		}
+		if seg.Offset == seg.End {
+			continue
+		}
+
+		src, dst := logFilePath(db.opts.DBPath, fe.FID), logFilePath(dir, fe.FID)
+		if seg.Offset == 0 && fe.FID != active {
+			err = linkOrCopyFile(src, dst, seg.End)
+		} else {
+			err = copyFileRange(src, dst, seg.Offset, seg.End)
+		}
+		if err != nil {
+			return err
+		}
+		info.Segments = append(info.Segments, seg)
+	}
+
+	return writeManifest(dir, &manifest{Files: files, Backup: info})
+}
+
+// backupState returns the extent of every log file and the id of the active
+// log file, which is synced so that the bytes backed up survive a crash. The
+// active log file is sealed first when seal is set, unless it holds no entry.
+func (db *DB) backupState(seal bool) ([]fileExtent, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, 0, ErrDBClosed
+	}
+
+	if seal && db.offset > db.activedLogFile.HeaderSize() {
+		if err := db.switchActivedLogFile(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := db.activedLogFile.Sync(); err != nil {
+		return nil, 0, err
+	}
+
+	files := make([]*LogFile, 0, len(db.archivedLogFile)+1)
+	for _, lf := range db.archivedLogFile {
+		files = append(files, lf)
+	}
+	if db.offset > db.activedLogFile.HeaderSize() {
+		files = append(files, db.activedLogFile)
+	}
+
+	state := make([]fileExtent, 0, len(files))
+	for _, lf := range files {
+		end, _ := lf.Size()
+		if lf == db.activedLogFile {
+			end = db.offset
+		}
+		state = append(state, fileExtent{FID: lf.FID(), CreatedAt: lf.createdAt, End: end})
+	}
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].FID < state[j].FID
+	})
+
+	return state, db.activedLogFile.FID(), nil
+}
+
+// Restore copies the backup of backupDir into dbPath, which must be empty or
+// not exist. The db is opened from dbPath afterwards, never from backupDir
+// whose log files may be shared with the db it was taken from.
+func Restore(backupDir, dbPath string) error {
+	return RestoreChain([]string{backupDir}, dbPath)
+}
+
+// RestoreChain restores a full backup followed by the incremental backups
+// taken from it, in order, into dbPath. The db is restored as it was at the
+// last backup.
+func RestoreChain(backupDirs []string, dbPath string) error {
+	chain := make([]*backupInfo, 0, len(backupDirs))
+	for i, dir := range backupDirs {
+		m, err := readManifest(dir)
+		if err != nil {
+			return err
+		}
+		if m.Backup == nil {
+			return ErrNotBackup
+		}
+		if i > 0 && m.Backup.Parent != chain[i-1].ID {
+			return ErrBrokenBackupChain
+		}
+		chain = append(chain, m.Backup)
+	}
+	if len(chain) == 0 {
+		return ErrNotBackup
+	}
+
+	if err := prepareDir(dbPath); err != nil {
+		return err
+	}
+
+	last := chain[len(chain)-1]
+	files := make([]int, 0, len(last.State))
+	for _, fe := range last.State {
+		if err := restoreLogFile(backupDirs, chain, fe, dbPath); err != nil {
+			return err
+		}
+		files = append(files, fe.FID)
+	}
+
+	return writeManifest(dbPath, &manifest{Files: files})
+}
+
+// restoreLogFile puts together the segments of the chain which belong to the
+// log file described by fe.
+func restoreLogFile(backupDirs []string, chain []*backupInfo, fe fileExtent, dbPath string) error {
+	out, err := os.OpenFile(logFilePath(dbPath, fe.FID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	covered := int64(0)
+	for i, info := range chain {
+		for _, seg := range info.Segments {
+			if seg.FID != fe.FID || seg.CreatedAt != fe.CreatedAt || seg.End <= covered {
+				continue
+			}
+			if seg.Offset > covered {
+				return ErrBrokenBackupChain
+			}
+
+			if err := appendSegment(out, logFilePath(backupDirs[i], seg.FID), seg, covered); err != nil {
+				return err
+			}
+			covered = seg.End
+		}
+	}
+	if covered < fe.End {
+		return ErrBrokenBackupChain
+	}
+
+	if err := out.Truncate(fe.End); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// appendSegment writes the bytes of seg, stored in path, from offset on.
+func appendSegment(out *os.File, path string, seg fileExtent, offset int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := io.NewSectionReader(in, offset-seg.Offset, seg.End-offset)
+	_, err = io.Copy(out, r)
+	return err
+}
+
+func findExtent(info *backupInfo, fid int) (fileExtent, bool) {
+	if info == nil {
+		return fileExtent{}, false
+	}
+	for _, fe := range info.State {
+		if fe.FID == fid {
+			return fe, true
+		}
+	}
+	return fileExtent{}, false
+}
+
+// prepareDir creates dir unless it exists, an existing dir must be empty.
+func prepareDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, os.ModePerm)
+	}
+	if err != nil {
+		return err
+	}
+	if len(infos) > 0 {
+		return ErrDirNotEmpty
+	}
+	return nil
+}
+
+// linkOrCopyFile hard-links src, whose size is size, to dst or copies it when
+// they are on different file systems.
+func linkOrCopyFile(src, dst string, size int64) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFileRange(src, dst, 0, size)
+}
+
+// copyFileRange copies the bytes of src from offset to end into dst.
+func copyFileRange(src, dst string, offset, end int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, io.NewSectionReader(in, offset, end-offset)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// readManifestFile reads the manifest at path, the directory holding it is
+// accepted too.
+func readManifestFile(path string) (*manifest, error) {
+	if filepath.Base(path) == ManifestFileName {
+		path = filepath.Dir(path)
+	}
+	return readManifest(path)
+}
@@ -0,0 +1,197 @@
+package peach
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackup(t *testing.T) {
+	dbPath, backupDir, restorePath := "/tmp/peach", "/tmp/peach-backup", "/tmp/peach-restore"
+	for _, path := range []string{dbPath, backupDir, restorePath} {
+		os.RemoveAll(path)
+	}
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	assert.Nil(t, db.Delete(kvs[0]))
+
+	// writes go on during the backup
+	more := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		more = append(more, utils.RandBytes(36))
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, kv := range more {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	wg.Wait()
+	assert.Equal(t, ErrDirNotEmpty, db.Backup(backupDir))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, Restore(backupDir, restorePath))
+	assert.Equal(t, ErrDirNotEmpty, Restore(backupDir, restorePath))
+
+	db, err = New(DefaultOptions(restorePath))
+	assert.Nil(t, err)
+	_, err = db.Get(kvs[0])
+	assert.Equal(t, ErrKeyNotFound, err)
+	for _, kv := range kvs[1:] {
+		value, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	// the restored db is writable without touching the backup
+	assert.Nil(t, db.Put(kvs[0], kvs[0]))
+	assert.Nil(t, db.Close())
+
+	m, err := readManifest(backupDir)
+	assert.Nil(t, err)
+	infos, err := os.ReadDir(backupDir)
+	assert.Nil(t, err)
+	assert.Len(t, infos, len(m.Files)+1)
+}
+
+func TestBackupSince(t *testing.T) {
+	dbPath, restorePath := "/tmp/peach", "/tmp/peach-restore"
+	dirs := []string{"/tmp/peach-backup", "/tmp/peach-backup-1", "/tmp/peach-backup-2"}
+	for _, path := range append([]string{dbPath, restorePath}, dirs...) {
+		os.RemoveAll(path)
+	}
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	assert.Nil(t, db.Backup(dirs[0]))
+
+	// overwrite and delete keys, then merge the log files with garbage
+	for _, kv := range kvs[:300] {
+		assert.Nil(t, db.Put(kv, kv[:10]))
+	}
+	for _, kv := range kvs[300:400] {
+		assert.Nil(t, db.Delete(kv))
+	}
+	assert.Nil(t, db.Compact(context.Background()))
+	assert.Nil(t, db.Put(kvs[999], kvs[999]))
+	assert.Nil(t, db.BackupSince(dirs[1], filepath.Join(dirs[0], ManifestFileName)))
+
+	// only the tail of the active log file changes
+	for _, kv := range kvs[400:410] {
+		assert.Nil(t, db.Put(kv, kv[:5]))
+	}
+	assert.Nil(t, db.BackupSince(dirs[2], dirs[1]))
+	m, err := readManifest(dirs[2])
+	assert.Nil(t, err)
+	assert.Len(t, m.Backup.Segments, 1)
+	assert.True(t, m.Backup.Segments[0].Offset > 0)
+	assert.Nil(t, db.Put(kvs[999], []byte("after the backups")))
+	assert.Nil(t, db.Close())
+
+	assert.Equal(t, ErrBrokenBackupChain, RestoreChain([]string{dirs[0], dirs[2]}, restorePath))
+	os.RemoveAll(restorePath)
+	assert.Nil(t, RestoreChain(dirs, restorePath))
+
+	db, err = New(DefaultOptions(restorePath))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(900), db.Size())
+	for i, kv := range kvs {
+		value, err := db.Get(kv)
+		switch {
+		case i < 300:
+			assert.True(t, reflect.DeepEqual(kv[:10], value))
+		case i < 400:
+			assert.Equal(t, ErrKeyNotFound, err)
+		case i < 410:
+			assert.True(t, reflect.DeepEqual(kv[:5], value))
+		default:
+			assert.True(t, reflect.DeepEqual(kv, value))
+		}
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestBackupSinceRepair(t *testing.T) {
+	dbPath, restorePath := "/tmp/peach", "/tmp/peach-restore"
+	dirs := []string{"/tmp/peach-backup", "/tmp/peach-backup-1"}
+	for _, path := range append([]string{dbPath, restorePath}, dirs...) {
+		os.RemoveAll(path)
+	}
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+	}
+	assert.Nil(t, db.Backup(dirs[0]))
+	assert.Nil(t, db.Close())
+
+	// the repaired log file has the id and about the size of the former one
+	f, err := os.OpenFile(logFilePath(dbPath, 1), os.O_RDWR, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 1000)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = Repair(dbPath)
+	assert.Nil(t, err)
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("after the repair"), []byte("v")))
+	assert.Nil(t, db.BackupSince(dirs[1], dirs[0]))
+
+	// it is copied as a whole
+	m, err := readManifest(dirs[1])
+	assert.Nil(t, err)
+	repaired, ok := findExtent(m.Backup, 1)
+	assert.True(t, ok)
+	assert.Equal(t, db.archivedLogFile[1].createdAt, repaired.CreatedAt)
+	for _, seg := range m.Backup.Segments {
+		if seg.FID == 1 {
+			assert.Equal(t, int64(0), seg.Offset)
+		}
+	}
+
+	assert.Nil(t, RestoreChain(dirs, restorePath))
+	restored, err := New(DefaultOptions(restorePath))
+	assert.Nil(t, err)
+	assert.Equal(t, db.Size(), restored.Size())
+	assert.Nil(t, db.Scan(nil, nil, func(k, v []byte) bool {
+		value, err := restored.Get(k)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(v, value))
+		return true
+	}))
+	assert.Nil(t, restored.Close())
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,100 @@
+package peach
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrEmptyBatch = errors.New("batch is empty")
+)
+
+type (
+	// Batch collects Put and Delete operations which are applied
+	// atomically by DB.Write.
+	Batch struct {
+		entries []*LogEntry
+	}
+)
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.append(Normal, time.Now().Unix(), key, value)
+}
+
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.append(ExpiredAt, expireTime(ttl), key, value)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.append(Delete, time.Now().Unix(), key, nil)
+}
+
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+func (b *Batch) append(typ LogEntryType, timestamp int64, key, value []byte) {
+	b.entries = append(b.entries, newLogEntry(typ, timestamp, key, value))
+}
+
+// newLogEntry copies key and value, the caller is free to reuse its buffers.
+func newLogEntry(typ LogEntryType, timestamp int64, key, value []byte) *LogEntry {
+	buf := make([]byte, len(key)+len(value))
+	copy(buf, key)
+	copy(buf[len(key):], value)
+
+	return &LogEntry{
+		Type:      typ,
+		Timestamp: timestamp,
+		Key:       buf[:len(key)],
+		Value:     buf[len(key):],
+	}
+}
+
+// Write applies all operations of b atomically. The entries are surrounded by
+// a BatchBegin and a BatchCommit marker in the log file, a batch without its
+// commit marker is discarded on reload.
+func (db *DB) Write(b *Batch) error {
+	if b == nil || len(b.entries) == 0 {
+		return ErrEmptyBatch
+	}
+
+	return db.update(func() error {
+		return db.writeBatch(b.entries)
+	})
+}
+
+func (db *DB) writeBatch(entries []*LogEntry) error {
+	now := time.Now().Unix()
+	les := make([]*LogEntry, 0, len(entries)+2)
+	les = append(les, &LogEntry{Type: BatchBegin, Timestamp: now, Key: []byte{}, Value: []byte{}})
+	les = append(les, entries...)
+	les = append(les, &LogEntry{Type: BatchCommit, Timestamp: now, Key: []byte{}, Value: []byte{}})
+
+	sizes, err := db.activedLogFile.WriteAll(db.offset, les)
+	if err != nil {
+		return err
+	}
+
+	offset := db.offset
+	for i, le := range les {
+		if le.Type != BatchBegin && le.Type != BatchCommit {
+			db.updateIndex(le, offset, sizes[i])
+		}
+		offset += int64(sizes[i])
+	}
+	db.offset = offset
+	db.writeSeq++
+
+	db.afterWrite()
+
+	return nil
+}
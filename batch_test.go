@@ -0,0 +1,66 @@
+package peach
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	db, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrEmptyBatch, db.Write(NewBatch()))
+
+	kvs := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+
+	batch := NewBatch()
+	for _, kv := range kvs[:50] {
+		batch.Delete(kv)
+	}
+	added := utils.RandBytes(36)
+	batch.Put(added, added)
+	assert.Equal(t, 51, batch.Len())
+	assert.Nil(t, db.Write(batch))
+	assert.Equal(t, int64(51), db.Size())
+	assert.Nil(t, db.Close())
+
+	// append a batch without commit marker, as if the process crashed
+	lf, err := NewLogFile(dbPath, 0)
+	assert.Nil(t, err)
+	size, err := lf.Size()
+	assert.Nil(t, err)
+	torn := []*LogEntry{
+		{Type: BatchBegin, Timestamp: time.Now().Unix(), Key: []byte{}, Value: []byte{}},
+		{Type: Delete, Timestamp: time.Now().Unix(), Key: added, Value: []byte{}},
+	}
+	_, err = lf.WriteAll(size, torn)
+	assert.Nil(t, err)
+	assert.Nil(t, lf.Close())
+
+	db2, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(51), db2.Size())
+	assert.Equal(t, size, db2.offset)
+
+	for _, kv := range kvs[:50] {
+		_, err := db2.Get(kv)
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for _, kv := range append(kvs[50:], added) {
+		value, err := db2.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	assert.Nil(t, db2.Close())
+}
@@ -0,0 +1,378 @@
+// Command peach inspects and operates a peach database.
+//
+// Usage:
+//
+//	peach -db <path> [-key-file <file>] <command> [arguments]
+//
+// The commands which only read the database open it read-only, they work
+// while another process holds it open.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/muyisensen/peach"
+)
+
+var (
+	errUsage  = errors.New("invalid usage")
+	errLocked = errors.New("database is locked by another process")
+)
+
+type (
+	command struct {
+		usage    string
+		readOnly bool
+		run      func(db *peach.DB, args []string, stdin io.Reader, stdout io.Writer) error
+	}
+)
+
+var commands = map[string]*command{
+	"get":     {usage: "get <key>", readOnly: true, run: get},
+	"put":     {usage: "put [-ttl duration] <key> <value>", run: put},
+	"del":     {usage: "del <key>", run: del},
+	"scan":    {usage: "scan [-prefix prefix] [-limit n]", readOnly: true, run: scan},
+	"stats":   {usage: "stats", readOnly: true, run: stats},
+	"compact": {usage: "compact", run: compact},
+	"export":  {usage: "export [-format jsonl|binary] [-o file]", readOnly: true, run: export},
+	"import":  {usage: "import [-format jsonl|binary] [-i file]", run: importCmd},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "peach: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("peach", flag.ContinueOnError)
+	dbPath := fs.String("db", ".", "database directory")
+	keyFile := fs.String("key-file", "", "file holding the raw encryption key of the database")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: peach -db <path> [-key-file <file>] <command> [arguments]\n\ncommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(fs.Output(), "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(fs.Output(), "  verify\n  repair\n  dump-log <file>\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		k, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key = k
+	}
+
+	name, rest := fs.Arg(0), fs.Args()[1:]
+	switch name {
+	case "verify":
+		return verify(*dbPath, stdout)
+	case "repair":
+		return repair(*dbPath, stdout)
+	case "dump-log":
+		if len(rest) != 1 {
+			return errUsage
+		}
+		return dumpLog(rest[0], key, stdout)
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	db, closeDB, err := openDB(*dbPath, key, cmd.readOnly)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	return cmd.run(db, rest, stdin, stdout)
+}
+
+// openDB opens the database at dbPath encrypted with key, if any, read-only
+// for the commands which do not write so that they work alongside the process
+// holding it open.
+func openDB(dbPath string, key []byte, readOnly bool) (*peach.DB, func(), error) {
+	opts := peach.DefaultOptions(dbPath)
+	opts.ReadOnly = readOnly
+	opts.EncryptionKey = key
+	// the tool leaves the merges to the process owning the database
+	opts.CompactionTrigger = 0
+
+	if !readOnly {
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	db, err := peach.New(opts)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, nil, errLocked
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, func() { db.Close() }, nil
+}
+
+func logFileID(name string) (int, bool) {
+	if !strings.HasPrefix(name, peach.LogFileNamePrefix) {
+		return 0, false
+	}
+	fid, err := strconv.Atoi(strings.TrimPrefix(name, peach.LogFileNamePrefix))
+	return fid, err == nil
+}
+
+func get(db *peach.DB, args []string, _ io.Reader, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	value, err := db.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(stdout, "%s\n", value)
+	return err
+}
+
+func put(db *peach.DB, args []string, _ io.Reader, _ io.Writer) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "time to live of the key, 0 means no ttl")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	key, value := []byte(fs.Arg(0)), []byte(fs.Arg(1))
+	if *ttl > 0 {
+		return db.PutWithTTL(key, value, *ttl)
+	}
+	return db.Put(key, value)
+}
+
+func del(db *peach.DB, args []string, _ io.Reader, _ io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return db.Delete([]byte(args[0]))
+}
+
+func scan(db *peach.DB, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only the keys starting with prefix")
+	limit := fs.Int("limit", 0, "maximum number of keys, 0 means no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		count int
+		err   error
+	)
+	if scanErr := db.PrefixScan([]byte(*prefix), func(k, v []byte) bool {
+		count++
+		_, err = fmt.Fprintf(stdout, "%s\t%s\n", k, v)
+		return err == nil && (*limit <= 0 || count < *limit)
+	}); scanErr != nil {
+		return scanErr
+	}
+
+	return err
+}
+
+func stats(db *peach.DB, _ []string, _ io.Reader, stdout io.Writer) error {
+	s := db.Stats()
+	fmt.Fprintf(stdout, "keys: %d\n", s.Keys)
+	fmt.Fprintf(stdout, "total bytes: %d\n", s.TotalBytes)
+	fmt.Fprintf(stdout, "live bytes: %d\n", s.LiveBytes)
+	fmt.Fprintf(stdout, "dead bytes: %d\n", s.DeadBytes)
+	fmt.Fprintf(stdout, "garbage ratio: %.2f\n", s.GarbageRatio())
+	fmt.Fprintf(stdout, "scrubbed bytes: %d\n", s.ScrubbedBytes)
+	fmt.Fprintf(stdout, "scrub corruptions: %d\n", s.ScrubCorruptions)
+	fmt.Fprintf(stdout, "files:\n")
+	for _, f := range s.Files {
+		active := ""
+		if f.Actived {
+			active = " (active)"
+		}
+		fmt.Fprintf(stdout, "  %s%d%s: size %d, live %d, dead %d, garbage ratio %.2f\n",
+			peach.LogFileNamePrefix, f.FID, active, f.Size, f.LiveBytes, f.DeadBytes, f.GarbageRatio())
+	}
+	return nil
+}
+
+func compact(db *peach.DB, _ []string, _ io.Reader, _ io.Writer) error {
+	return db.Compact(context.Background())
+}
+
+func export(db *peach.DB, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "jsonl or binary")
+	out := fs.String("o", "", "output file, the standard output by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := peach.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return db.Export(stdout, f)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := db.Export(file, f); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func importCmd(db *peach.DB, args []string, stdin io.Reader, _ io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "jsonl or binary")
+	in := fs.String("i", "", "input file, the standard input by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := peach.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return peach.Import(db, stdin, f)
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return peach.Import(db, file, f)
+}
+
+// verify reports the corrupt ranges of the log files of dbPath.
+func verify(dbPath string, stdout io.Writer) error {
+	reports, err := peach.Verify(dbPath)
+	if err != nil {
+		return err
+	}
+
+	corrupted := printReports(reports, stdout)
+	if corrupted > 0 {
+		return fmt.Errorf("%d corrupted log files", corrupted)
+	}
+	return nil
+}
+
+// repair rewrites the corrupted log files of dbPath with the entries left.
+func repair(dbPath string, stdout io.Writer) error {
+	reports, err := peach.Repair(dbPath)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+	if err != nil {
+		return err
+	}
+
+	if corrupted := printReports(reports, stdout); corrupted > 0 {
+		fmt.Fprintf(stdout, "%d log files repaired\n", corrupted)
+	}
+	return nil
+}
+
+func printReports(reports []peach.FileReport, stdout io.Writer) int {
+	corrupted := 0
+	for _, report := range reports {
+		name := filepath.Base(report.Path)
+		if !report.Corrupted() {
+			fmt.Fprintf(stdout, "%s: ok, %d entries\n", name, report.Entries)
+			continue
+		}
+
+		corrupted++
+		fmt.Fprintf(stdout, "%s: corrupted, %d entries left\n", name, report.Entries)
+		for _, cr := range report.Corrupt {
+			fmt.Fprintf(stdout, "  %v\n", cr)
+		}
+	}
+	return corrupted
+}
+
+// dumpLog prints the header and every entry of a log file, the batch markers
+// included. The entries of an encrypted log file are decrypted with key.
+func dumpLog(path string, key []byte, stdout io.Writer) error {
+	fid, ok := logFileID(filepath.Base(path))
+	if !ok {
+		return fmt.Errorf("%s is not a log file", path)
+	}
+	lf, err := peach.OpenLogFile(path, fid)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	if lf.Version() > 0 {
+		fmt.Fprintf(stdout, "# version %d, created %s, flags %#x\n", lf.Version(),
+			lf.CreatedAt().UTC().Format(time.RFC3339), lf.Flags())
+	}
+	if key != nil {
+		if err := lf.Unlock(key); err != nil {
+			return err
+		}
+	}
+	for offset := lf.HeaderSize(); ; {
+		le, size, err := lf.Load(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", offset, err)
+		}
+
+		fmt.Fprintf(stdout, "%d\t%s\t%s\t%q\t%d bytes\n", offset, le.Type,
+			time.Unix(le.Timestamp, 0).UTC().Format(time.RFC3339), le.Key, len(le.Value))
+		offset += int64(size)
+	}
+}
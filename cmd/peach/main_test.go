@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/muyisensen/peach"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	dbPath := "/tmp/peach-cli"
+	os.RemoveAll(dbPath)
+	assert.Nil(t, os.MkdirAll(dbPath, os.ModePerm))
+
+	exec := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(append([]string{"-db", dbPath}, args...), strings.NewReader(""), &out)
+		return out.String(), err
+	}
+
+	_, err := exec("put", "a1", "v1")
+	assert.Nil(t, err)
+	_, err = exec("put", "-ttl", "1h", "a2", "v2")
+	assert.Nil(t, err)
+	_, err = exec("put", "b1", "v3")
+	assert.Nil(t, err)
+
+	out, err := exec("get", "a1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1\n", out)
+
+	out, err = exec("scan", "-prefix", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, "a1\tv1\na2\tv2\n", out)
+
+	out, err = exec("scan", "-limit", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "a1\tv1\n", out)
+
+	_, err = exec("del", "a1")
+	assert.Nil(t, err)
+	_, err = exec("get", "a1")
+	assert.Equal(t, peach.ErrKeyNotFound, err)
+
+	out, err = exec("stats")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "keys: 2\n")
+
+	_, err = exec("compact")
+	assert.Nil(t, err)
+
+	out, err = exec("verify")
+	assert.Nil(t, err)
+	assert.NotContains(t, out, "corrupted")
+
+	out, err = exec("repair")
+	assert.Nil(t, err)
+	assert.NotContains(t, out, "repaired")
+
+	out, err = exec("export")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(out, "\n"))
+
+	_, err = exec("unknown")
+	assert.NotNil(t, err)
+
+	// the db is held by another process
+	db, err := peach.New(peach.DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("c1"), []byte("v4")))
+
+	out, err = exec("get", "c1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v4\n", out)
+
+	files := db.Stats().Files
+	out, err = exec("dump-log", fmt.Sprintf("%s/%s%d", dbPath, peach.LogFileNamePrefix, files[len(files)-1].FID))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(out, fmt.Sprintf("# version %d,", peach.LogFileVersion)))
+
+	// the file is opened read-only, an empty one is left as is
+	emptyPath := fmt.Sprintf("%s/%s%d", dbPath, peach.LogFileNamePrefix, 1000)
+	_, err = exec("dump-log", emptyPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, os.WriteFile(emptyPath, nil, os.ModePerm))
+	out, err = exec("dump-log", emptyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "", out)
+	stat, err := os.Stat(emptyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+	assert.Nil(t, os.Remove(emptyPath))
+
+	_, err = exec("put", "c2", "v5")
+	assert.Equal(t, errLocked, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestRunEncrypted(t *testing.T) {
+	dbPath := "/tmp/peach-cli"
+	os.RemoveAll(dbPath)
+	assert.Nil(t, os.MkdirAll(dbPath, os.ModePerm))
+
+	keyFile := dbPath + ".key"
+	assert.Nil(t, os.WriteFile(keyFile, bytes.Repeat([]byte{7}, 32), os.ModePerm))
+	defer os.Remove(keyFile)
+
+	exec := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(append([]string{"-db", dbPath}, args...), strings.NewReader(""), &out)
+		return out.String(), err
+	}
+
+	_, err := exec("-key-file", keyFile, "put", "a1", "v1")
+	assert.Nil(t, err)
+
+	out, err := exec("-key-file", keyFile, "get", "a1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1\n", out)
+
+	_, err = exec("get", "a1")
+	assert.Equal(t, peach.ErrWrongEncryptionKey, err)
+
+	out, err = exec("verify")
+	assert.Nil(t, err)
+	assert.NotContains(t, out, "corrupted")
+
+	logPath := fmt.Sprintf("%s/%s%d", dbPath, peach.LogFileNamePrefix, 0)
+	out, err = exec("-key-file", keyFile, "dump-log", logPath)
+	assert.Nil(t, err)
+	assert.Contains(t, out, fmt.Sprintf("%q", "a1"))
+
+	// the header is printed before the entries fail to decrypt
+	out, err = exec("dump-log", logPath)
+	assert.True(t, errors.Is(err, peach.ErrWrongEncryptionKey))
+	assert.True(t, strings.HasPrefix(out, fmt.Sprintf("# version %d,", peach.LogFileVersion)))
+}
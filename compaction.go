@@ -0,0 +1,457 @@
+package peach
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MergeFileNamePrefix = "merge."
+
+	// mergeChunkSize is the number of entries checked against the index at
+	// once, the read lock is held meanwhile.
+	mergeChunkSize = 256
+)
+
+type (
+	// mergeJob copies the live entries of the picked log files into a merge
+	// file, without holding the lock of DB. Once complete the merge file takes
+	// the place of the newest picked log file: the copied entries are older
+	// than anything written since the merge started, so they replay before it.
+	mergeJob struct {
+		db    *DB
+		files []*LogFile
+		// tombstones tells whether the deletes of a picked log file may hide
+		// entries of an older log file which is kept
+		tombstones map[int]bool
+		out        *LogFile
+		offset     int64
+		pending    []scanned
+		// scannedBytes is the size of the pending entries in the log files
+		scannedBytes int
+		moves        []*move
+		expired      []*move
+	}
+
+	scanned struct {
+		le     *LogEntry
+		fid    int
+		offset int64
+	}
+
+	// move records an entry copied to the merge file, the index is pointed at
+	// the copy only if it still references the original entry.
+	move struct {
+		key    []byte
+		fid    int
+		offset int64
+		to     int64
+		size   int
+	}
+)
+
+// Compact merges the log files with enough garbage until none is left. When
+// ctx is done the running merge is abandoned and ctx.Err() is returned.
+func (db *DB) Compact(ctx context.Context) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.gcMu.Lock()
+	defer db.gcMu.Unlock()
+
+	for {
+		merged, err := db.merge(ctx)
+		if err != nil || !merged {
+			return err
+		}
+	}
+}
+
+// autoCompact merges log files while the garbage ratio is above trigger, it
+// does nothing when a merge is already running.
+func (db *DB) autoCompact(trigger float64) error {
+	if !db.gcMu.TryLock() {
+		return nil
+	}
+	defer db.gcMu.Unlock()
+
+	for {
+		db.mu.RLock()
+		ratio := db.garbageRatio()
+		db.mu.RUnlock()
+		if ratio <= trigger {
+			return nil
+		}
+
+		merged, err := db.merge(context.Background())
+		if err == ErrDBClosed {
+			return nil
+		}
+		if err != nil || !merged {
+			return err
+		}
+	}
+}
+
+// garbageRatio returns the ratio of dead bytes to total bytes of the log
+// files, the read lock must be held.
+func (db *DB) garbageRatio() float64 {
+	stats := Stats{Files: db.fileStats()}
+	for _, fs := range stats.Files {
+		stats.TotalBytes += fs.Size
+		stats.DeadBytes += fs.DeadBytes
+	}
+	return stats.GarbageRatio()
+}
+
+// pickGcFiles returns the ids of the log files whose garbage ratio reaches
+// Options.CompactionFileGarbageRatio, the active log file included, and of
+// the outdated ones, so that the merges upgrade the files without header and
+// rotate the encryption key. The live bytes of the picked files are kept under
+// LogFileSizeThreshold, so that the index swap of one merge stays short.
+func (db *DB) pickGcFiles() []int {
+	var (
+		picked []int
+		live   int64
+	)
+	for _, fs := range db.fileStats() {
+		outdated := db.logFile(fs.FID).outdated(db.keys)
+		if !outdated && (fs.DeadBytes == 0 || fs.GarbageRatio() < db.opts.CompactionFileGarbageRatio) {
+			continue
+		}
+		if len(picked) > 0 && live+fs.LiveBytes > db.opts.LogFileSizeThreshold {
+			break
+		}
+		picked = append(picked, fs.FID)
+		live += fs.LiveBytes
+	}
+	return picked
+}
+
+// hasOlderKeptFile reports whether a log file older than fid is not picked,
+// it may hold entries which the deletes of fid hide.
+func (db *DB) hasOlderKeptFile(fid int, picked []int) bool {
+	for other := range db.archivedLogFile {
+		if other >= fid {
+			continue
+		}
+		i := sort.SearchInts(picked, other)
+		if i == len(picked) || picked[i] != other {
+			return true
+		}
+	}
+	return false
+}
+
+// merge runs one merge, it returns false when no log file has enough garbage.
+func (db *DB) merge(ctx context.Context) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	job, err := db.beginMerge()
+	if err != nil || job == nil {
+		return false, err
+	}
+	defer db.endMerge()
+
+	if err := job.run(ctx); err != nil {
+		job.abort()
+		return false, err
+	}
+
+	if err := job.commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// beginMerge picks the log files to merge and creates the merge file, the
+// active log file is sealed first when it is picked.
+func (db *DB) beginMerge() (*mergeJob, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	// a merge which failed once done is completed by the next reload
+	if db.mergeState != nil {
+		return nil, nil
+	}
+
+	picked := db.pickGcFiles()
+	if len(picked) == 0 {
+		return nil, nil
+	}
+
+	if picked[len(picked)-1] == db.activedLogFile.FID() {
+		if err := db.switchActivedLogFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	job := &mergeJob{db: db, tombstones: make(map[int]bool)}
+	for _, fid := range picked {
+		job.files = append(job.files, db.archivedLogFile[fid])
+		job.tombstones[fid] = db.hasOlderKeptFile(fid, picked)
+	}
+
+	fid := picked[len(picked)-1]
+	out, err := openLogFile(mergeFilePath(db.opts.DBPath, fid), fid, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	job.out = out
+	if err := out.Truncate(0); err != nil {
+		job.abort()
+		return nil, err
+	}
+	if err := db.prepareLogFile(out); err != nil {
+		job.abort()
+		return nil, err
+	}
+	job.offset = out.HeaderSize()
+
+	db.mergeState = &mergeState{Inputs: picked, Output: fid}
+	if err := db.saveManifest(); err != nil {
+		db.mergeState = nil
+		job.abort()
+		return nil, err
+	}
+
+	// Close waits for the merge, which gives up once closeCh is closed
+	db.inGc = true
+	db.wg.Add(1)
+
+	return job, nil
+}
+
+func (db *DB) endMerge() {
+	db.mu.Lock()
+	db.inGc = false
+	if ms := db.mergeState; ms != nil && !ms.Done {
+		db.mergeState = nil
+		if err := db.saveManifest(); err != nil {
+			log.Printf("save manifest fail, err msg: %v", err.Error())
+		}
+	}
+	db.mu.Unlock()
+	db.wg.Done()
+}
+
+// run copies the live entries of the picked log files to the merge file.
+func (j *mergeJob) run(ctx context.Context) error {
+	for _, lf := range j.files {
+		fid := lf.FID()
+		if _, err := lf.Scan(func(le *LogEntry, offset int64, size int) error {
+			j.pending = append(j.pending, scanned{le: le, fid: fid, offset: offset})
+			j.scannedBytes += size
+			if len(j.pending) < mergeChunkSize {
+				return nil
+			}
+			return j.flush(ctx)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := j.flush(ctx); err != nil {
+		return err
+	}
+
+	return j.out.Sync()
+}
+
+// flush checks the pending entries against the index under the read lock and
+// writes the live ones, along with the tombstones to keep, to the merge file.
+func (j *mergeJob) flush(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-j.db.closeCh:
+		return ErrDBClosed
+	default:
+	}
+
+	var (
+		now   = time.Now().Unix()
+		les   = make([]*LogEntry, 0, len(j.pending))
+		moves = make([]*move, 0, len(j.pending))
+	)
+	j.db.mu.RLock()
+	for _, item := range j.pending {
+		key := item.le.Key
+		memValue := j.db.lookup(key)
+		if item.le.Type == Delete {
+			if memValue == nil && j.tombstones[item.fid] {
+				les, moves = append(les, item.le), append(moves, nil)
+			}
+			continue
+		}
+
+		if memValue == nil || memValue.FileID != item.fid || memValue.Offset != item.offset {
+			continue
+		}
+
+		m := &move{key: key, fid: item.fid, offset: item.offset}
+		if memValue.IsExpired(now) {
+			j.expired = append(j.expired, m)
+			if j.tombstones[item.fid] {
+				les, moves = append(les, &LogEntry{
+					Type:      Delete,
+					Timestamp: now,
+					Key:       key,
+					Value:     []byte{},
+				}), append(moves, nil)
+			}
+			continue
+		}
+		les, moves = append(les, item.le), append(moves, m)
+	}
+	j.db.mu.RUnlock()
+	j.pending = j.pending[:0]
+
+	n := j.scannedBytes
+	j.scannedBytes = 0
+	if err := j.db.compactionLimiter.wait(ctx, j.db.closeCh, n); err != nil {
+		return err
+	}
+
+	if len(les) == 0 {
+		return nil
+	}
+
+	sizes, err := j.out.WriteAll(j.offset, les)
+	if err != nil {
+		return err
+	}
+	written := 0
+	for _, size := range sizes {
+		written += size
+	}
+	if err := j.db.compactionLimiter.wait(ctx, j.db.closeCh, written); err != nil {
+		return err
+	}
+	for i, size := range sizes {
+		if m := moves[i]; m != nil {
+			m.to, m.size = j.offset, size
+			j.moves = append(j.moves, m)
+		} else {
+			// a kept tombstone is needed as long as the merge file lives
+			j.out.addLive(int64(size))
+		}
+		j.offset += int64(size)
+	}
+
+	return nil
+}
+
+// commit records the merge as done in the manifest, puts the merge file in
+// place of the newest picked log file, removes the other ones and points the
+// index at the copied entries.
+func (j *mergeJob) commit() error {
+	db := j.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		j.abort()
+		return ErrDBClosed
+	}
+
+	// once the manifest says the merge is done a reload completes it, the
+	// merge file must be kept whatever happens next
+	ms := db.mergeState
+	ms.Done = true
+	if err := db.saveManifest(); err != nil {
+		ms.Done = false
+		j.abort()
+		return err
+	}
+
+	fid := j.out.FID()
+	if err := db.finishMerge(ms); err != nil {
+		return err
+	}
+	j.out.path = logFilePath(db.opts.DBPath, fid)
+
+	// a memValue is updated in place, a Txn tells versions apart by pointer
+	for _, m := range j.moves {
+		memValue := db.lookup(m.key)
+		if memValue == nil || memValue.FileID != m.fid || memValue.Offset != m.offset {
+			continue
+		}
+		memValue.FileID, memValue.Offset, memValue.Size = fid, m.to, m.size
+		j.out.addLive(int64(m.size))
+	}
+	for _, m := range j.expired {
+		memValue := db.lookup(m.key)
+		if memValue != nil && memValue.FileID == m.fid && memValue.Offset == m.offset {
+			db.index0.Delete(m.key)
+			db.size--
+		}
+	}
+
+	var err error
+	for _, lf := range j.files {
+		delete(db.archivedLogFile, lf.FID())
+		if cerr := db.retire(lf); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	db.archivedLogFile[fid] = j.out
+	db.lastGCTime = time.Now()
+	db.mergeState = nil
+	if serr := db.saveManifest(); serr != nil && err == nil {
+		err = serr
+	}
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		if err := db.writeHintFile(j.out); err != nil {
+			log.Printf("write hint file of %v fail, err msg: %v", j.out.Path(), err.Error())
+		}
+	}()
+
+	return err
+}
+
+func (j *mergeJob) abort() {
+	j.out.Close()
+	os.Remove(j.out.Path())
+}
+
+func mergeFilePath(dirPath string, fid int) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%s%d", MergeFileNamePrefix, fid))
+}
+
+// removeMergeFiles removes the merge files left behind by an interrupted merge.
+func (db *DB) removeMergeFiles() error {
+	infos, err := ioutil.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), MergeFileNamePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.opts.DBPath, info.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
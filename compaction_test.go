@@ -0,0 +1,233 @@
+package peach
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompact(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kvs = append(kvs, utils.RandBytes(36))
+	}
+	for i := 0; i < 3; i++ {
+		for _, kv := range kvs {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+	}
+	assert.InDelta(t, 2.0/3, db.garbageRatio(), 0.05)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.Compact(ctx))
+
+	assert.Nil(t, db.Compact(context.Background()))
+	stats := db.Stats()
+	assert.False(t, stats.InGc)
+	assert.Equal(t, int64(1000), stats.Keys)
+	assert.InDelta(t, 0, stats.GarbageRatio(), 0.01)
+	// only the log files full of garbage have been rewritten
+	for _, fs := range stats.Files {
+		assert.True(t, fs.Actived || fs.DeadBytes == 0)
+	}
+
+	for _, kv := range kvs {
+		value, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), db.Size())
+	assert.InDelta(t, 0, db.garbageRatio(), 0.01)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, ErrDBClosed, db.Compact(context.Background()))
+}
+
+func TestCompactionTrigger(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0.5
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	db.mu.RLock()
+	assert.True(t, db.lastGCTime.IsZero())
+	db.mu.RUnlock()
+
+	for _, kv := range kvs {
+		assert.Nil(t, db.Delete(kv))
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	db.mu.RLock()
+	assert.False(t, db.lastGCTime.IsZero())
+	db.mu.RUnlock()
+	assert.Nil(t, db.Close())
+}
+
+func TestCompactKeepsDeletes(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	cold := make([][]byte, 0, 300)
+	for i := 0; i < 300; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		cold = append(cold, kv)
+	}
+	for _, kv := range cold[:10] {
+		assert.Nil(t, db.Delete(kv))
+	}
+
+	hot := []byte("hot")
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(hot, utils.RandBytes(36)))
+	}
+
+	before := db.Stats()
+	assert.Nil(t, db.Compact(context.Background()))
+	after := db.Stats()
+	assert.True(t, after.TotalBytes < before.TotalBytes/2)
+	// the log files of the cold keys are mostly live, they are kept
+	_, ok := db.archivedLogFile[0]
+	assert.True(t, ok)
+	assert.Nil(t, db.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(291), db.Size())
+	for _, kv := range cold[:10] {
+		_, err := db.Get(kv)
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for _, kv := range cold[10:] {
+		value, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestCompactConcurrentWrites(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		kvs = append(kvs, utils.RandBytes(36))
+	}
+	for i := 0; i < 2; i++ {
+		for _, kv := range kvs {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+	}
+
+	// the writes go on while the merges copy the log files
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Compact(context.Background())
+	}()
+	for i, kv := range kvs {
+		switch i % 3 {
+		case 0:
+			assert.Nil(t, db.Delete(kv))
+		case 1:
+			assert.Nil(t, db.Put(kv, kv[:10]))
+		}
+	}
+	assert.Nil(t, <-done)
+
+	check := func(db *DB) {
+		for i, kv := range kvs {
+			value, err := db.Get(kv)
+			switch i % 3 {
+			case 0:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case 1:
+				assert.True(t, reflect.DeepEqual(kv[:10], value))
+			default:
+				assert.True(t, reflect.DeepEqual(kv, value))
+			}
+		}
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	check(db)
+	assert.Nil(t, db.Compact(context.Background()))
+	check(db)
+	assert.Nil(t, db.Close())
+}
+
+func TestCompactionRate(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	opts.CompactionBytesPerSecond = 32 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kvs = append(kvs, utils.RandBytes(36))
+	}
+	for i := 0; i < 2; i++ {
+		for _, kv := range kvs {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+	}
+
+	// about 200KB are read and written, the first 32KB come from the bucket
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	assert.Equal(t, context.DeadlineExceeded, db.Compact(ctx))
+	cancel()
+	assert.False(t, db.Stats().InGc)
+
+	db.SetCompactionRate(0)
+	start := time.Now()
+	assert.Nil(t, db.Compact(context.Background()))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.InDelta(t, 0, db.Stats().GarbageRatio(), 0.05)
+	assert.Nil(t, db.Close())
+}
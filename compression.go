@@ -0,0 +1,282 @@
+package peach
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// CompressionNone stores the values as they are.
+	CompressionNone Compression = iota
+	// CompressionFlate compresses the values with DEFLATE, the algorithm of
+	// gzip, for the best ratio.
+	CompressionFlate
+	// CompressionLZ compresses the values with a built-in LZ4-style codec,
+	// faster than flate for a lower ratio.
+	CompressionLZ
+
+	// the compression of a value is kept in the high bits of the type byte of
+	// its entry, below the encryption bit, the ones written before compression
+	// existed have none
+	compressionShift = 5
+	compressionMask  = 3
+	entryTypeMask    = 1<<compressionShift - 1
+
+	lzMinMatch  = 4
+	lzHashLog   = 12
+	lzMaxOffset = 1<<16 - 1
+)
+
+var (
+	ErrInvalidCompression = errors.New("invalid compressed value")
+)
+
+var (
+	flateWriterPool = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	}
+	flateReaderPool = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+type (
+	Compression uint8
+
+	// entryCodec encodes the entries written to a log file, compressing the
+	// values of at least threshold bytes and encrypting them with aead unless
+	// it is nil.
+	entryCodec struct {
+		compression Compression
+		threshold   int
+		aead        cipher.AEAD
+		noncePrefix []byte
+	}
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	case CompressionLZ:
+		return "lz"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+func (c entryCodec) encode(le *LogEntry) []byte {
+	if c.compression == CompressionNone || len(le.Value) < c.threshold || len(le.Value) == 0 {
+		return encode(le, CompressionNone, le.Value, c.aead, c.noncePrefix)
+	}
+
+	value, err := compress(c.compression, le.Value)
+	if err != nil || len(value) >= len(le.Value) {
+		return encode(le, CompressionNone, le.Value, c.aead, c.noncePrefix)
+	}
+
+	return encode(le, c.compression, value, c.aead, c.noncePrefix)
+}
+
+func (c entryCodec) decode(raw []byte) (*LogEntry, error) {
+	return decode(raw, c.aead, c.noncePrefix)
+}
+
+func compress(c Compression, value []byte) ([]byte, error) {
+	switch c {
+	case CompressionFlate:
+		var buf bytes.Buffer
+		w := flateWriterPool.Get().(*flate.Writer)
+		defer flateWriterPool.Put(w)
+
+		w.Reset(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionLZ:
+		return lzCompress(value), nil
+	default:
+		return nil, ErrInvalidCompression
+	}
+}
+
+func decompress(c Compression, value []byte) ([]byte, error) {
+	switch c {
+	case CompressionFlate:
+		r := flateReaderPool.Get().(io.ReadCloser)
+		defer flateReaderPool.Put(r)
+
+		if err := r.(flate.Resetter).Reset(bytes.NewReader(value), nil); err != nil {
+			return nil, err
+		}
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return nil, ErrInvalidCompression
+		}
+		return raw, nil
+	case CompressionLZ:
+		return lzDecompress(value)
+	default:
+		return nil, ErrInvalidCompression
+	}
+}
+
+// lzCompress encodes src as its size followed by LZ4 sequences: a token made
+// of the literal length and the match length, the literals, then the offset
+// and the match length past the token, the last sequence has no match.
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)/2+binary.MaxVarintLen64)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << lzHashLog]int32
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lzHashLog)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || i-candidate > lzMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = lzAppendSequence(dst, src[anchor:i], i-candidate, length)
+		i += length
+		anchor = i
+	}
+
+	return lzAppendSequence(dst, src[anchor:], 0, 0)
+}
+
+func lzAppendSequence(dst, literals []byte, offset, length int) []byte {
+	literalLen, matchLen := len(literals), length-lzMinMatch
+
+	token := byte(minInt(literalLen, 15)) << 4
+	if length > 0 {
+		token |= byte(minInt(matchLen, 15))
+	}
+
+	dst = append(dst, token)
+	if literalLen >= 15 {
+		dst = lzAppendLength(dst, literalLen-15)
+	}
+	dst = append(dst, literals...)
+	if length == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen >= 15 {
+		dst = lzAppendLength(dst, matchLen-15)
+	}
+	return dst
+}
+
+func lzAppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	// a sequence of a few bytes expands to at most a few hundred
+	if n <= 0 || size > uint64(len(src))*255 {
+		return nil, ErrInvalidCompression
+	}
+	src = src[n:]
+
+	var err error
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+
+		literalLen := int(token >> 4)
+		if literalLen == 15 {
+			if literalLen, src, err = lzReadLength(src, literalLen); err != nil {
+				return nil, err
+			}
+		}
+		if literalLen > len(src) {
+			return nil, ErrInvalidCompression
+		}
+		dst = append(dst, src[:literalLen]...)
+		src = src[literalLen:]
+		if len(src) == 0 {
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, ErrInvalidCompression
+		}
+		offset := int(src[0]) | int(src[1])<<8
+		src = src[2:]
+
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			if matchLen, src, err = lzReadLength(src, matchLen); err != nil {
+				return nil, err
+			}
+		}
+		matchLen += lzMinMatch
+
+		if offset == 0 || offset > len(dst) || uint64(len(dst)+matchLen) > size {
+			return nil, ErrInvalidCompression
+		}
+		// the match may overlap the bytes it produces
+		start := len(dst) - offset
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, ErrInvalidCompression
+	}
+	return dst, nil
+}
+
+func lzReadLength(src []byte, n int) (int, []byte, error) {
+	for {
+		if len(src) == 0 {
+			return 0, nil, ErrInvalidCompression
+		}
+		b := src[0]
+		src = src[1:]
+		n += int(b)
+		if b != 255 {
+			return n, src, nil
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
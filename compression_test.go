@@ -0,0 +1,122 @@
+package peach
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	values := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte{'x'}, 10000),
+		utils.RandBytes(1000),
+		append(utils.RandBytes(300), bytes.Repeat(utils.RandBytes(20), 50)...),
+		[]byte(`{"id":1,"name":"peach","tags":["kv","bitcask"],"name2":"peach","tags2":["kv","bitcask"]}`),
+	}
+
+	for _, c := range []Compression{CompressionFlate, CompressionLZ} {
+		for _, value := range values {
+			compressed, err := compress(c, value)
+			assert.Nil(t, err)
+			raw, err := decompress(c, compressed)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(value, raw), "%v %d bytes", c, len(value))
+		}
+	}
+
+	compressed := lzCompress(bytes.Repeat([]byte{'x'}, 10000))
+	assert.True(t, len(compressed) < 100)
+	_, err := lzDecompress(compressed[:len(compressed)-2])
+	assert.Equal(t, ErrInvalidCompression, err)
+
+	// an entry is compressed only when it gets smaller
+	codec := entryCodec{compression: CompressionLZ, threshold: 16}
+	for _, value := range values {
+		le := &LogEntry{Type: Normal, Key: []byte("key"), Value: value}
+		raw := codec.encode(le)
+		assert.True(t, len(raw) <= len(Encode(le)))
+
+		decoded, err := Decode(raw)
+		assert.Nil(t, err)
+		assert.Equal(t, Normal, decoded.Type)
+		assert.True(t, bytes.Equal(value, decoded.Value))
+	}
+}
+
+func TestDBCompression(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 64 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	// a JSON blob with the same fields over and over
+	value := func(i int) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("[")
+		for j := 0; j < 8; j++ {
+			fmt.Fprintf(&buf, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":true,"roles":["reader","writer"]},`, i*8+j, i, j)
+		}
+		buf.WriteString("{}]")
+		return buf.Bytes()
+	}
+
+	// written before compression is enabled
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), value(i)))
+	}
+	uncompressed := db.Stats().TotalBytes
+	assert.Nil(t, db.Close())
+
+	for _, c := range []Compression{CompressionFlate, CompressionLZ} {
+		opts.Compression = c
+		opts.CompressionThreshold = 64
+		db, err = New(opts)
+		assert.Nil(t, err)
+
+		before := db.Stats().TotalBytes
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), value(i)))
+		}
+		assert.True(t, 2*(db.Stats().TotalBytes-before) < uncompressed, "%v", c)
+		assert.Nil(t, db.Close())
+
+		db, err = New(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(value(i), v))
+		}
+
+		// the merges copy compressed and uncompressed values alike
+		for i := 0; i < 1000; i += 2 {
+			assert.Nil(t, db.Delete([]byte(fmt.Sprintf("key-%d", i))))
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), value(i)))
+		}
+		assert.Nil(t, db.Compact(context.Background()))
+		for i := 0; i < 1000; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(value(i), v))
+		}
+
+		reports, err := Verify(dbPath)
+		assert.Nil(t, err)
+		for _, report := range reports {
+			assert.False(t, report.Corrupted())
+		}
+		assert.Nil(t, db.Close())
+	}
+}
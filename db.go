@@ -2,14 +2,9 @@ package peach
 
 import (
 	"errors"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -20,83 +15,133 @@ import (
 
 const (
 	LockFileName = "LOCK"
+	// ReadLockFileName is locked shared by the dbs opened read-only.
+	ReadLockFileName = "READLOCK"
+
+	// NoExpiration is returned by DB.TTL for keys without ttl.
+	NoExpiration time.Duration = -1
 )
 
 var (
-	ErrLogFileNotExist = errors.New("log file not exist")
-	ErrKeyNotFound     = errors.New("key not found")
+	ErrLogFileNotExist  = errors.New("log file not exist")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrUncommittedBatch = errors.New("uncommitted batch")
+	ErrDBClosed         = errors.New("db is closed")
+	ErrReadOnly         = errors.New("db is read-only")
 )
 
 type (
 	DB struct {
-		mu              sync.RWMutex
-		size            int64
-		opts            *Options
-		index0          index.MemTable
-		activedLogFile  *LogFile
-		offset          int64
-		archivedLogFile map[int]*LogFile
-		index1          index.MemTable
-		inGc            bool
-		lastGCTime      time.Time
-		fileLock        *FileLock
+		mu                sync.RWMutex
+		size              int64
+		opts              *Options
+		index0            index.MemTable
+		activedLogFile    *LogFile
+		offset            int64
+		archivedLogFile   map[int]*LogFile
+		gcMu              sync.Mutex
+		inGc              bool
+		mergeState        *mergeState
+		snapshots         map[*Snapshot]struct{}
+		retiredLogFile    map[*LogFile]struct{}
+		compactionLimiter *rateLimiter
+		scrubMu           sync.Mutex
+		scrubLimiter      *rateLimiter
+		scrubbedBytes     int64
+		scrubCorruptions  int64
+		keys              *keyRing
+		lastGCTime        time.Time
+		fileLock          *FileLock
+		truncatedBytes    int64
+		writeSeq          uint64
+		unsynced          []*LogFile
+		syncer            *syncer
+		closeCh           chan struct{}
+		wg                sync.WaitGroup
+		closed            bool
 	}
 )
 
 func New(opts *Options) (*DB, error) {
+	if opts.ReadOnly {
+		return openReadOnly(opts)
+	}
+
 	if !utils.Exist(opts.DBPath) {
 		if err := os.MkdirAll(opts.DBPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
-	db := &DB{
-		opts:            opts,
-		index0:          art.NewAdaptiveRadixTree(opts.ArtOpt),
-		archivedLogFile: make(map[int]*LogFile),
-		fileLock:        NewFlock(filepath.Join(opts.DBPath, LockFileName)),
+	db, err := newDB(opts, LockFileName)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := db.fileLock.TryLock(); err != nil {
 		return nil, err
 	}
 
+	// the read-only dbs do not write to the directory, their lock file is
+	// created for them
+	if err := createLockFile(filepath.Join(opts.DBPath, ReadLockFileName)); err != nil {
+		db.fileLock.ULock()
+		return nil, err
+	}
+
 	if err := db.reload(); err != nil {
+		db.fileLock.ULock()
 		return nil, err
 	}
 
+	db.wg.Add(1)
 	go db.eventHandle()
 
+	if opts.SyncPolicy.mode == syncEveryInterval {
+		db.wg.Add(1)
+		go db.syncLoop(opts.SyncPolicy.interval)
+	}
+
+	if opts.ScrubInterval > 0 {
+		db.wg.Add(1)
+		go db.scrubLoop(opts.ScrubInterval)
+	}
+
 	return db, nil
 }
 
-func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	memValue := db.index0.Get(key)
-	if memValue == nil && db.index1 != nil {
-		memValue = db.index1.Get(key)
+func newDB(opts *Options, lockFileName string) (*DB, error) {
+	keys, err := newKeyRing(opts.EncryptionKey, opts.DecryptionKeys)
+	if err != nil {
+		return nil, err
 	}
 
-	if memValue == nil {
-		return nil, ErrKeyNotFound
+	db := &DB{
+		opts:            opts,
+		index0:          art.NewAdaptiveRadixTree(opts.ArtOpt),
+		archivedLogFile: make(map[int]*LogFile),
+		fileLock:        NewFlock(filepath.Join(opts.DBPath, lockFileName)),
+		closeCh:         make(chan struct{}),
+		snapshots:       make(map[*Snapshot]struct{}),
+		retiredLogFile:  make(map[*LogFile]struct{}),
+		keys:            keys,
 	}
+	db.compactionLimiter = newRateLimiter(opts.CompactionBytesPerSecond)
+	db.scrubLimiter = newRateLimiter(opts.ScrubBytesPerSecond)
+	db.syncer = newSyncer(db)
 
-	var logFile *LogFile
-	if lf, ok := db.archivedLogFile[memValue.FileID]; ok {
-		logFile = lf
-	}
+	return db, nil
+}
 
-	if db.activedLogFile.FID() == memValue.FileID {
-		logFile = db.activedLogFile
-	}
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	if logFile == nil {
-		return nil, ErrLogFileNotExist
+	if db.closed {
+		return nil, ErrDBClosed
 	}
 
-	le, err := logFile.Read(memValue.Offset, memValue.Size)
+	le, err := db.get(key)
 	if err != nil {
 		return nil, err
 	}
@@ -105,362 +150,544 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 }
 
 func (db *DB) Put(key, value []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.update(func() error {
+		return db.put(&LogEntry{
+			Type:      Normal,
+			Timestamp: time.Now().Unix(),
+			Key:       key,
+			Value:     value,
+		})
+	})
+}
 
-	size, err := db.activedLogFile.Write(db.offset, &LogEntry{
-		Type:      Normal,
-		Timestamp: time.Now().Unix(),
-		Key:       key,
-		Value:     value,
+// PutWithTTL sets the value for key, the key expires after ttl.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.update(func() error {
+		return db.put(&LogEntry{
+			Type:      ExpiredAt,
+			Timestamp: expireTime(ttl),
+			Key:       key,
+			Value:     value,
+		})
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	memValue := &index.MemValue{
-		FileID: db.activedLogFile.FID(),
-		Offset: db.offset,
-		Size:   size,
+// expireTime returns the unix time at which a key written now with ttl expires,
+// it is rounded up so that the key never expires before ttl has elapsed.
+func expireTime(ttl time.Duration) int64 {
+	t := time.Now().Add(ttl)
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
 	}
-	db.offset += int64(size)
+	return t.Unix()
+}
 
-	var replaced *index.MemValue
-	if db.inGc && db.index1 != nil {
-		replaced = db.index1.Put(key, memValue)
-	} else {
-		replaced = db.index0.Put(key, memValue)
+// Expire sets a ttl on an existing key, replacing any previous one.
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	return db.update(func() error {
+		le, err := db.get(key)
+		if err != nil {
+			return err
+		}
+
+		return db.put(&LogEntry{
+			Type:      ExpiredAt,
+			Timestamp: expireTime(ttl),
+			Key:       key,
+			Value:     le.Value,
+		})
+	})
+}
+
+// Persist removes the ttl of key, it is a no-op for a key without ttl.
+func (db *DB) Persist(key []byte) error {
+	return db.update(func() error {
+		memValue := db.lookup(key)
+		if memValue == nil || memValue.IsExpired(time.Now().Unix()) {
+			return ErrKeyNotFound
+		}
+
+		if memValue.ExpiredAt == nil {
+			return nil
+		}
+
+		le, err := db.get(key)
+		if err != nil {
+			return err
+		}
+
+		return db.put(&LogEntry{
+			Type:      Normal,
+			Timestamp: time.Now().Unix(),
+			Key:       key,
+			Value:     le.Value,
+		})
+	})
+}
+
+// TTL returns the remaining time to live of key, or NoExpiration if the key
+// does not expire.
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, ErrDBClosed
 	}
 
-	if replaced == nil {
-		db.size++
+	now := time.Now()
+	memValue := db.lookup(key)
+	if memValue == nil || memValue.IsExpired(now.Unix()) {
+		return 0, ErrKeyNotFound
 	}
 
-	if err := db.doGc(); err != nil {
-		log.Printf("doGc fail, err msg: %v", err.Error())
+	if memValue.ExpiredAt == nil {
+		return NoExpiration, nil
 	}
 
-	if fileSize, err := db.activedLogFile.Size(); err != nil {
-		log.Printf("call LogFile.Size() fail, err msg: %v", err.Error())
-	} else if fileSize > db.opts.LogFileSizeThreshold && !db.inGc {
-		if err := db.switchActivedLogFile(); err != nil {
-			log.Printf("call switchActivedLogFile fail, err msg: %v", err.Error())
+	return time.Unix(*memValue.ExpiredAt, 0).Sub(now), nil
+}
+
+func (db *DB) Delete(key []byte) error {
+	return db.update(func() error {
+		if deleted := db.lookup(key); deleted == nil {
+			return nil
 		}
+
+		return db.put(&LogEntry{
+			Type:      Delete,
+			Timestamp: time.Now().Unix(),
+			Key:       key,
+			Value:     []byte{},
+		})
+	})
+}
+
+// Sync flushes every write made so far to stable storage.
+func (db *DB) Sync() error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDBClosed
 	}
+	seq := db.writeSeq
+	db.mu.RUnlock()
 
-	return nil
+	return db.syncer.wait(seq)
 }
 
-func (db *DB) Delete(key []byte) error {
+// Close stops the background goroutines, aborting an in-progress merge, and
+// closes the log files. Any later operation fails with ErrDBClosed, calling
+// Close again is a no-op.
+func (db *DB) Close() error {
 	db.mu.Lock()
-	defer db.mu.Unlock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
 
-	deleted := db.index0.Get(key)
-	if deleted == nil && db.index1 != nil {
-		deleted = db.index1.Get(key)
+	close(db.closeCh)
+	db.wg.Wait()
+
+	// the files are closed and the lock released whatever fails, the first
+	// error is returned
+	var err error
+	if !db.opts.ReadOnly {
+		_, err = db.syncActived()
 	}
 
-	if deleted == nil {
-		return nil
+	if closeErr := db.closeLogFiles(); err == nil {
+		err = closeErr
 	}
 
-	size, err := db.activedLogFile.Write(db.offset, &LogEntry{
-		Type:      Delete,
-		Timestamp: time.Now().Unix(),
-		Key:       key,
-		Value:     []byte{},
-	})
-	if err != nil {
-		return err
+	// the log files pinned by snapshots are closed along with the db
+	for logFile := range db.retiredLogFile {
+		if closeErr := logFile.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	db.offset += int64(size)
 
-	if db.inGc && db.index1 != nil {
-		db.index1.Delete(key)
-	} else {
-		db.index0.Delete(key)
+	if unlockErr := db.fileLock.ULock(); err == nil {
+		err = unlockErr
 	}
-	db.size--
+	return err
+}
 
-	if err := db.doGc(); err != nil {
-		log.Printf("doGc fail, err msg: %v", err.Error())
+// closeLogFiles closes the active and archived log files.
+// closeLogFiles closes every log file, it returns the first error.
+func (db *DB) closeLogFiles() error {
+	var err error
+	if db.activedLogFile != nil {
+		err = db.activedLogFile.Close()
 	}
 
-	if fileSize, err := db.activedLogFile.Size(); err != nil {
-		log.Printf("call LogFile.Size() fail, err msg: %v", err.Error())
-	} else if fileSize > db.opts.LogFileSizeThreshold && !db.inGc {
-		if err := db.switchActivedLogFile(); err != nil {
-			log.Printf("call switchActivedLogFile fail, err msg: %v", err.Error())
+	for _, logFile := range db.archivedLogFile {
+		if closeErr := logFile.Close(); err == nil {
+			err = closeErr
 		}
 	}
 
-	return nil
+	return err
 }
 
-func (db *DB) Sync() error {
-	if err := db.activedLogFile.Sync(); err != nil {
-		return nil
-	}
-	return nil
+func (db *DB) Size() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.size
 }
 
-func (db *DB) Close() error {
-	if err := db.Sync(); err != nil {
-		return err
+// TruncatedBytes returns the number of bytes dropped from the tail of the
+// active log file when the DB was opened, see truncateTornTail.
+func (db *DB) TruncatedBytes() int64 {
+	return db.truncatedBytes
+}
+
+func (db *DB) lookup(key []byte) *index.MemValue {
+	return db.index0.Get(key)
+}
+
+// newLogFile opens the log file fid, the entries written to it are encoded as
+// set by the options.
+func (db *DB) newLogFile(fid int) (*LogFile, error) {
+	lf, err := openLogFile(logFilePath(db.opts.DBPath, fid), fid, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := db.activedLogFile.Close(); err != nil {
-		return err
+	if err := db.prepareLogFile(lf); err != nil {
+		lf.Close()
+		return nil, err
 	}
+	return lf, nil
+}
 
-	for _, item := range db.archivedLogFile {
-		logFile := item
-		if err := logFile.Close(); err != nil {
-			return err
-		}
+// prepareLogFile sets the compression of lf and writes its header when it is
+// empty, encrypting it with the current key, see LogFile.prepare.
+func (db *DB) prepareLogFile(lf *LogFile) error {
+	lf.codec.compression = db.opts.Compression
+	lf.codec.threshold = db.opts.CompressionThreshold
+	return lf.prepare(db.keys)
+}
+
+func (db *DB) logFile(fid int) *LogFile {
+	if db.activedLogFile != nil && db.activedLogFile.FID() == fid {
+		return db.activedLogFile
 	}
+	return db.archivedLogFile[fid]
+}
 
-	return db.fileLock.ULock()
+func (db *DB) get(key []byte) (*LogEntry, error) {
+	memValue := db.lookup(key)
+	if memValue == nil || memValue.IsExpired(time.Now().Unix()) {
+		return nil, ErrKeyNotFound
+	}
+
+	return db.read(memValue)
 }
 
-func (db *DB) Size() int64 {
-	return db.size
+func (db *DB) read(memValue *index.MemValue) (*LogEntry, error) {
+	logFile := db.logFile(memValue.FileID)
+	if logFile == nil {
+		return nil, ErrLogFileNotExist
+	}
+
+	return logFile.Read(memValue.Offset, memValue.Size)
 }
 
-func (db *DB) reload() error {
-	infos, err := ioutil.ReadDir(db.opts.DBPath)
+func (db *DB) put(le *LogEntry) error {
+	size, err := db.activedLogFile.Write(db.offset, le)
 	if err != nil {
 		return err
 	}
 
-	fids := make([]int, 0, len(infos))
-	for _, info := range infos {
-		if !strings.HasPrefix(info.Name(), LogFileNamePrefix) {
-			continue
-		}
+	db.updateIndex(le, db.offset, size)
+	db.offset += int64(size)
+	db.writeSeq++
 
-		items := strings.Split(info.Name(), ".")
-		if len(items) < 2 {
-			continue
+	db.afterWrite()
+
+	return nil
+}
+
+func (db *DB) updateIndex(le *LogEntry, offset int64, size int) {
+	db.captureSnapshots(le.Key)
+
+	if le.Type == Delete {
+		if deleted := db.index0.Delete(le.Key); deleted != nil {
+			db.size--
+			db.release(deleted)
 		}
+		return
+	}
 
-		fid, err := strconv.Atoi(items[1])
-		if err != nil {
-			return err
+	memValue := &index.MemValue{
+		FileID: db.activedLogFile.FID(),
+		Offset: offset,
+		Size:   size,
+	}
+	if le.Type == ExpiredAt {
+		expiredAt := le.Timestamp
+		memValue.ExpiredAt = &expiredAt
+	}
+
+	replaced := db.index0.Put(le.Key, memValue)
+	db.activedLogFile.addLive(int64(size))
+	if replaced == nil {
+		db.size++
+	} else {
+		db.release(replaced)
+	}
+}
+
+// release accounts the entry of a replaced or deleted value as dead bytes.
+func (db *DB) release(memValue *index.MemValue) {
+	if lf := db.logFile(memValue.FileID); lf != nil {
+		lf.addLive(-int64(memValue.Size))
+	}
+}
+
+func (db *DB) afterWrite() {
+	if fileSize, err := db.activedLogFile.Size(); err != nil {
+		log.Printf("call LogFile.Size() fail, err msg: %v", err.Error())
+	} else if fileSize > db.opts.LogFileSizeThreshold {
+		if err := db.switchActivedLogFile(); err != nil {
+			log.Printf("call switchActivedLogFile fail, err msg: %v", err.Error())
 		}
-		fids = append(fids, fid)
 	}
-	sort.Ints(fids)
+}
+
+func (db *DB) reload() error {
+	fids, err := db.loadManifest()
+	if err != nil {
+		return err
+	}
 
 	for i, fid := range fids {
-		logFile, err := NewLogFile(db.opts.DBPath, fid)
+		logFile, err := db.newLogFile(fid)
 		if err != nil {
 			return err
 		}
 
+		// the log file is registered first, the live bytes are accounted
+		// while the index is rebuilt
+		if i < len(fids)-1 {
+			db.archivedLogFile[fid] = logFile
+			if err := db.reloadArchived(logFile); err != nil {
+				return err
+			}
+			continue
+		}
+
+		db.activedLogFile = logFile
 		offset, err := db.reloadIndex(logFile)
-		if err != nil {
+		if err != nil && !isCorrupted(err) {
 			return err
 		}
-
-		if i == len(fids)-1 {
-			db.offset = offset
-			db.activedLogFile = logFile
-		} else {
-			db.archivedLogFile[fid] = logFile
+		if err := db.truncateTornTail(logFile, offset, err); err != nil {
+			return err
 		}
+		db.offset = offset
+	}
+
+	if err := db.removeStaleHintFile(); err != nil {
+		return err
+	}
+
+	if err := db.removeMergeFiles(); err != nil {
+		return err
 	}
 
 	if db.activedLogFile == nil {
-		logFile, err := NewLogFile(db.opts.DBPath, 0)
+		logFile, err := db.newLogFile(0)
 		if err != nil {
-			return nil
+			return err
 		}
 		db.activedLogFile = logFile
+		db.offset = logFile.HeaderSize()
 	}
 
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+
+	// the log files without header or written with a former key are
+	// rewritten by the merges, starting with the active one
+	if db.activedLogFile.outdated(db.keys) {
+		return db.switchActivedLogFile()
+	}
 	return nil
 }
 
 func (db *DB) reloadIndex(lf *LogFile) (int64, error) {
-	offset := int64(0)
-	for {
-		le, size, err := lf.Load(offset)
-		switch err {
-		case nil:
-		case io.EOF:
-			return offset, nil
-		default:
-			return 0, err
-		}
-
-		if le.Type == Delete {
-			if deleted := db.index0.Delete(le.Key); deleted != nil {
-				db.size--
-			}
-			offset += int64(size)
-			continue
-		}
-
-		var expiredAt *int64
-		if le.Type == ExpiredAt {
-			if time.Now().Unix() < le.Timestamp {
-				expiredAt = &le.Timestamp
-			} else {
-				offset += int64(size)
-				continue
-			}
-		}
+	return lf.Scan(func(le *LogEntry, offset int64, size int) error {
+		db.reloadEntry(le, lf.FID(), offset, size)
+		return nil
+	})
+}
 
-		db.index0.Put(le.Key, &index.MemValue{
-			FileID:    lf.fid,
-			Offset:    offset,
-			Size:      size,
-			ExpiredAt: expiredAt,
-		})
-		offset += int64(size)
-		db.size++
+// truncateTornTail drops whatever follows the last committed entry of the
+// active log file: a torn write or an uncommitted batch left by a crash. A
+// broken entry followed by valid ones is a corruption, not a torn write, the
+// file is then left alone and a *CorruptedError returned.
+func (db *DB) truncateTornTail(lf *LogFile, offset int64, cause error) error {
+	size, err := lf.Size()
+	if err != nil {
+		return err
+	}
+	if offset >= size {
+		return nil
 	}
-}
 
-func (db *DB) eventHandle() {
-	logFileGcTicker := time.NewTicker(db.opts.LogFileGCInterval)
-	gcTicker := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-logFileGcTicker.C:
-			if db.inGc {
-				continue
-			}
-			if err := db.startGc(); err != nil {
-				log.Printf("start gc fail, err msg: %v", err.Error())
-			}
-		case <-gcTicker.C:
-			if err := db.gc(); err != nil {
-				log.Printf("gc fail, err msg: %v", err.Error())
-			}
-		default:
-			time.Sleep(5 * time.Second)
+	if cause != nil {
+		bad, resynced, err := resyncAfter(lf, offset)
+		if err != nil {
+			return err
+		}
+		if resynced {
+			return &CorruptedError{Path: lf.Path(), Offset: bad, Err: cause}
 		}
 	}
-}
 
-func (db *DB) startGc() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	if err := lf.Truncate(offset); err != nil {
+		return err
+	}
+	db.truncatedBytes = size - offset
 
-	db.inGc = true
-	db.index1 = art.NewAdaptiveRadixTree(db.opts.ArtOpt)
-	db.lastGCTime = time.Now()
+	if cause == nil {
+		cause = ErrUncommittedBatch
+	}
+	log.Printf("truncate %d bytes from the tail of %v at offset %d, cause: %v",
+		db.truncatedBytes, lf.Path(), offset, cause.Error())
 
-	return db.switchActivedLogFile()
+	return nil
 }
 
-func (db *DB) gc() error {
-	now := time.Now()
-	if !db.inGc || now.Before(db.lastGCTime.Add(5*time.Second)) {
-		return nil
+// resyncAfter finds the first entry of lf from offset on which can not be
+// decoded and reports whether a valid entry starts past it, as walkLogFile
+// does. A torn write is followed by none.
+func resyncAfter(lf *LogFile, offset int64) (int64, bool, error) {
+	size, err := lf.Size()
+	if err != nil {
+		return 0, false, err
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	timeout := time.NewTicker(500 * time.Millisecond)
-	for {
-		select {
-		case <-timeout.C:
-			return nil
-		default:
-			if err := db.doGc(); err != nil {
-				return err
+	for offset < size {
+		raw, _, err := loadValid(lf, offset)
+		if err != nil {
+			if !isCorrupted(err) && err != ErrInvalidEntryType {
+				return offset, false, err
 			}
+			break
 		}
+		offset += int64(len(raw))
 	}
-}
 
-func (db *DB) doGc() error {
-	if !db.inGc {
-		return nil
+	for next := offset + 1; next < size; next++ {
+		_, _, err := loadValid(lf, next)
+		if err == nil {
+			return offset, true, nil
+		}
+		if !isCorrupted(err) && err != ErrInvalidEntryType {
+			return offset, false, err
+		}
 	}
+	return offset, false, nil
+}
 
-	key, value := db.index0.Minimum()
-	if len(key) == 0 || value == nil {
-		db.index0 = db.index1
-		db.index1 = nil
-		db.inGc = false
-		return db.removeArchivedLogFile()
+func (db *DB) reloadEntry(le *LogEntry, fid int, offset int64, size int) {
+	var expiredAt *int64
+	if le.Type == ExpiredAt {
+		expiredAt = &le.Timestamp
 	}
 
-	if value.FileID == db.activedLogFile.FID() {
-		return nil
-	}
-
-	now := time.Now().Unix()
-	if value.ExpiredAt != nil && *value.ExpiredAt < now {
-		db.index0.Delete(key)
-		db.lastGCTime = time.Now()
-		return nil
+	if le.Type == Delete || (expiredAt != nil && *expiredAt <= time.Now().Unix()) {
+		if deleted := db.index0.Delete(le.Key); deleted != nil {
+			db.size--
+			db.release(deleted)
+		}
+		return
 	}
 
-	logFile, ok := db.archivedLogFile[value.FileID]
-	if !ok {
-		return ErrLogFileNotExist
+	replaced := db.index0.Put(le.Key, &index.MemValue{
+		FileID:    fid,
+		Offset:    offset,
+		Size:      size,
+		ExpiredAt: expiredAt,
+	})
+	if lf := db.logFile(fid); lf != nil {
+		lf.addLive(int64(size))
 	}
-
-	le, err := logFile.Read(value.Offset, value.Size)
-	switch err {
-	case nil:
-	case io.EOF:
-		return nil
-	default:
-		return err
+	if replaced == nil {
+		db.size++
+	} else {
+		db.release(replaced)
 	}
+}
 
-	size, err := db.activedLogFile.Write(db.offset, le)
-	if err != nil {
-		return err
-	}
+func (db *DB) eventHandle() {
+	defer db.wg.Done()
 
-	value.FileID = db.activedLogFile.FID()
-	value.Offset = db.offset
-	db.index1.Put(key, value)
-	db.index0.Delete(key)
-	db.lastGCTime = time.Now()
-	db.offset += int64(size)
+	logFileGcTicker := time.NewTicker(db.opts.LogFileGCInterval)
+	defer logFileGcTicker.Stop()
+	gcTicker := time.NewTicker(time.Second)
+	defer gcTicker.Stop()
 
-	return nil
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-logFileGcTicker.C:
+			// an idle db without garbage is not rewritten
+			if err := db.autoCompact(0); err != nil {
+				log.Printf("gc fail, err msg: %v", err.Error())
+			}
+		case <-gcTicker.C:
+			if trigger := db.opts.CompactionTrigger; trigger > 0 {
+				if err := db.autoCompact(trigger); err != nil {
+					log.Printf("gc fail, err msg: %v", err.Error())
+				}
+			}
+		}
+	}
 }
 
 func (db *DB) switchActivedLogFile() error {
 	current := db.activedLogFile
 	currentFid := current.FID()
-	logFile, err := NewLogFile(db.opts.DBPath, currentFid+1)
+	logFile, err := db.newLogFile(currentFid + 1)
 	if err != nil {
 		return err
 	}
 
-	db.archivedLogFile[currentFid] = db.activedLogFile
+	// nothing is written to the new log file before the manifest lists it
+	db.archivedLogFile[currentFid] = current
 	db.activedLogFile = logFile
-	db.offset = 0
-	return current.Sync()
-}
+	if err := db.saveManifest(); err != nil {
+		delete(db.archivedLogFile, currentFid)
+		db.activedLogFile = current
+		logFile.Close()
+		os.Remove(logFile.Path())
+		return err
+	}
 
-func (db *DB) removeArchivedLogFile() error {
-	fids := make([]int, 0, len(db.archivedLogFile))
-	for fid := range db.archivedLogFile {
-		fids = append(fids, fid)
+	db.offset = logFile.HeaderSize()
+	if err := current.Sync(); err != nil {
+		// the writes to current are not durable, the syncs retry it before
+		// reporting any later write durable
+		db.unsynced = append(db.unsynced, current)
+		return err
 	}
-	sort.Ints(fids)
 
-	for _, fid := range fids {
-		if lf, ok := db.archivedLogFile[fid]; ok {
-			if err := os.Remove(lf.Path()); err != nil {
-				return err
-			}
-			delete(db.archivedLogFile, fid)
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		if err := db.writeHintFile(current); err != nil {
+			log.Printf("write hint file of %v fail, err msg: %v", current.Path(), err.Error())
 		}
-
-	}
+	}()
 
 	return nil
 }
@@ -1,12 +1,15 @@
 package peach
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/muyisensen/peach/utils"
 	"github.com/stretchr/testify/assert"
@@ -137,15 +140,12 @@ func TestLogFileGc(t *testing.T) {
 
 	assert.Equal(t, int64(5000), db.Size())
 
-	assert.Nil(t, db.startGc())
-	assert.True(t, db.inGc)
-	for {
-		if !db.inGc {
-			break
-		}
-		assert.Nil(t, db.doGc())
+	before := len(db.archivedLogFile)
+	assert.Nil(t, db.Compact(context.Background()))
+	assert.True(t, len(db.archivedLogFile) < before)
+	for _, fs := range db.Stats().Files {
+		assert.True(t, fs.Actived || fs.DeadBytes == 0)
 	}
-	assert.Len(t, db.archivedLogFile, 0)
 
 	infos, err := ioutil.ReadDir(dbPath)
 	assert.Nil(t, err)
@@ -155,13 +155,23 @@ func TestLogFileGc(t *testing.T) {
 			count++
 		}
 	}
-	assert.Equal(t, count, 1)
+	assert.Equal(t, count, len(db.archivedLogFile)+1)
 
 	for _, kv := range kvs[5000:] {
 		value, err := db.Get(kv)
 		assert.Nil(t, err)
 		assert.True(t, reflect.DeepEqual(value, kv))
 	}
+	assert.Nil(t, db.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5000), db.Size())
+	for _, kv := range kvs[:5000] {
+		_, err := db.Get(kv)
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	assert.Nil(t, db.Close())
 }
 
 func BenchmarkSet(b *testing.B) {
@@ -226,3 +236,220 @@ func BenchmarkDelete(b *testing.B) {
 		assert.Nil(b, db.Delete(kv))
 	}
 }
+
+func TestTTL(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	db, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+
+	key, value := []byte("hello"), []byte("world")
+	_, err = db.TTL(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrKeyNotFound, db.Expire(key, time.Minute))
+	assert.Equal(t, ErrKeyNotFound, db.Persist(key))
+
+	assert.Nil(t, db.Put(key, value))
+	ttl, err := db.TTL(key)
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	assert.Nil(t, db.Expire(key, time.Minute))
+	ttl, err = db.TTL(key)
+	assert.Nil(t, err)
+	// the expiration time is rounded up to the second
+	assert.True(t, ttl > 58*time.Second && ttl <= time.Minute+time.Second)
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(value, got))
+
+	assert.Nil(t, db.Persist(key))
+	ttl, err = db.TTL(key)
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	expiredKey := []byte("expired")
+	assert.Nil(t, db.Put(expiredKey, value))
+	assert.Nil(t, db.PutWithTTL(expiredKey, value, time.Second))
+	assert.Equal(t, int64(2), db.Size())
+
+	// a sub-second ttl does not expire the key right away
+	fractionalKey := []byte("fractional")
+	assert.Nil(t, db.PutWithTTL(fractionalKey, value, 900*time.Millisecond))
+	got, err = db.Get(fractionalKey)
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(value, got))
+	ttl, err = db.TTL(fractionalKey)
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0)
+	time.Sleep(2 * time.Second)
+
+	_, err = db.Get(fractionalKey)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	_, err = db.Get(expiredKey)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(expiredKey)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+
+	db2, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), db2.Size())
+	_, err = db2.Get(expiredKey)
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err = db2.Get(key)
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(value, got))
+	assert.Nil(t, db2.Close())
+}
+
+func TestTornWrite(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	activedPath, size := db.activedLogFile.Path(), db.offset
+	archivedPath := db.archivedLogFile[0].Path()
+	assert.Nil(t, db.Close())
+
+	// half of an entry at the tail of the active log file
+	raw := Encode(&LogEntry{Type: Normal, Timestamp: time.Now().Unix(), Key: []byte("torn"), Value: []byte("write")})
+	f, err := os.OpenFile(activedPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.Write(raw[:len(raw)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(raw)/2), db.TruncatedBytes())
+	assert.Equal(t, int64(1000), db.Size())
+	info, err := os.Stat(activedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+
+	for _, kv := range kvs {
+		value, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	assert.Nil(t, db.Close())
+
+	// a broken entry followed by valid ones is no torn write
+	f, err = os.OpenFile(activedPath, os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 200)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = New(opts)
+	var corrupted *CorruptedError
+	assert.True(t, errors.As(err, &corrupted))
+	assert.Equal(t, activedPath, corrupted.Path)
+	assert.True(t, corrupted.Offset <= 200)
+	info, err = os.Stat(activedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+
+	_, err = Repair(dbPath)
+	assert.Nil(t, err)
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), db.TruncatedBytes())
+	assert.True(t, db.Size() >= 990)
+	assert.Nil(t, db.Close())
+
+	// a corrupted sealed log file is not truncated
+	for _, path := range []string{activedPath, archivedPath} {
+		assert.Nil(t, os.RemoveAll(strings.Replace(path, LogFileNamePrefix, HintFileNamePrefix, 1)))
+	}
+	f, err = os.OpenFile(archivedPath, os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = New(opts)
+	assert.True(t, errors.As(err, &corrupted))
+	assert.Equal(t, archivedPath, corrupted.Path)
+	assert.True(t, corrupted.Offset <= 100)
+}
+
+func TestClose(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.SyncPolicy = SyncEveryInterval(time.Millisecond)
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	for _, kv := range kvs {
+		assert.Nil(t, db.Put(kv, kv))
+	}
+
+	// a merge in progress is abandoned
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- db.Compact(context.Background())
+	}()
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, db.Close())
+	if err := <-errCh; err != nil {
+		assert.Equal(t, ErrDBClosed, err)
+	}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+
+	kv := kvs[0]
+	assert.Equal(t, ErrDBClosed, db.Put(kv, kv))
+	assert.Equal(t, ErrDBClosed, db.Delete(kv))
+	assert.Equal(t, ErrDBClosed, db.Sync())
+	assert.Equal(t, ErrDBClosed, db.Scan(nil, nil, func(k, v []byte) bool { return true }))
+	assert.Equal(t, ErrDBClosed, db.View(func(tx *Txn) error { return nil }))
+	_, err = db.Get(kv)
+	assert.Equal(t, ErrDBClosed, err)
+	assert.False(t, db.NewIterator(IteratorOptions{}).Valid())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	for _, kv := range kvs {
+		value, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+
+	// a failed sync still closes the log files and releases the lock
+	active := db.activedLogFile
+	file := active.file
+	closed, err := os.Open(active.Path())
+	assert.Nil(t, err)
+	assert.Nil(t, closed.Close())
+	active.file = closed
+	assert.NotNil(t, db.Close())
+	assert.Nil(t, db.Close())
+	assert.Nil(t, file.Close())
+	for _, lf := range db.archivedLogFile {
+		assert.True(t, errors.Is(lf.file.Close(), os.ErrClosed))
+	}
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,145 @@
+package peach
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// the nonce of an entry is the nonce prefix of its file followed by a
+	// random suffix stored in front of the ciphertext
+	noncePrefixSize = 4
+	nonceSuffixSize = 8
+
+	// entryEncrypted is set in the type byte of an encrypted entry
+	entryEncrypted = 1 << 7
+)
+
+var (
+	ErrWrongEncryptionKey = errors.New("wrong encryption key")
+)
+
+type (
+	// keyRing holds the keys which decrypt the log files by key id, id is the
+	// one encrypting the new log files, 0 for none.
+	keyRing struct {
+		id   uint32
+		keys map[uint32]cipher.AEAD
+	}
+)
+
+// newKeyRing returns the key ring encrypting with key and decrypting with
+// key and oldKeys, the keys are 16, 24 or 32 bytes long.
+func newKeyRing(key []byte, oldKeys [][]byte) (*keyRing, error) {
+	r := &keyRing{keys: make(map[uint32]cipher.AEAD)}
+	for i, k := range append([][]byte{key}, oldKeys...) {
+		if len(k) == 0 {
+			continue
+		}
+
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		id := keyID(k)
+		r.keys[id] = aead
+		if i == 0 {
+			r.id = id
+		}
+	}
+
+	return r, nil
+}
+
+// keyID identifies key without revealing it, it is never 0.
+func keyID(key []byte) uint32 {
+	sum := sha256.Sum256(append([]byte("peach key id:"), key...))
+	if id := binary.LittleEndian.Uint32(sum[:4]); id != 0 {
+		return id
+	}
+	return 1
+}
+
+func (r *keyRing) get(id uint32) (cipher.AEAD, bool) {
+	if r == nil {
+		return nil, false
+	}
+	aead, ok := r.keys[id]
+	return aead, ok
+}
+
+func (r *keyRing) currentID() uint32 {
+	if r == nil {
+		return 0
+	}
+	return r.id
+}
+
+// unlock gets the key of the file from keys, it fails with
+// ErrWrongEncryptionKey when keys does not hold it.
+func (f *LogFile) unlock(keys *keyRing) error {
+	if f.keyID == 0 {
+		return nil
+	}
+
+	aead, ok := keys.get(f.keyID)
+	if !ok {
+		return ErrWrongEncryptionKey
+	}
+	f.codec.aead = aead
+	return nil
+}
+
+// Unlock sets the key decrypting the entries of a file opened by OpenLogFile,
+// it fails with ErrWrongEncryptionKey when the file is encrypted with another.
+func (f *LogFile) Unlock(key []byte) error {
+	keys, err := newKeyRing(key, nil)
+	if err != nil {
+		return err
+	}
+	return f.unlock(keys)
+}
+
+// seal encrypts key and value of an entry whose header is header, it returns
+// the nonce suffix followed by the ciphertext.
+func seal(aead cipher.AEAD, noncePrefix, header, key, value []byte) []byte {
+	nonce := make([]byte, noncePrefixSize+nonceSuffixSize)
+	copy(nonce, noncePrefix)
+	rand.Read(nonce[noncePrefixSize:])
+
+	plain := make([]byte, 0, len(key)+len(value))
+	plain = append(append(plain, key...), value...)
+
+	out := make([]byte, nonceSuffixSize, nonceSuffixSize+len(plain)+aead.Overhead())
+	copy(out, nonce[noncePrefixSize:])
+	return aead.Seal(out, nonce, plain, header)
+}
+
+// open decrypts what seal returned.
+func open(aead cipher.AEAD, noncePrefix, header, sealed []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	if len(sealed) < nonceSuffixSize+aead.Overhead() {
+		return nil, ErrInvalidHeader
+	}
+
+	nonce := make([]byte, noncePrefixSize+nonceSuffixSize)
+	copy(nonce, noncePrefix)
+	copy(nonce[noncePrefixSize:], sealed[:nonceSuffixSize])
+
+	plain, err := aead.Open(nil, nonce, sealed[nonceSuffixSize:], header)
+	if err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	return plain, nil
+}
@@ -0,0 +1,177 @@
+package peach
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	keyA, keyB := utils.RandBytes(32), utils.RandBytes(16)
+
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	opts.Compression = CompressionLZ
+	opts.CompressionThreshold = 16
+	opts.EncryptionKey = keyA
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	marker := []byte("plaintext-marker")
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("%s-%d-%s", marker, i, bytes.Repeat(marker, 4)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("%s-key-%d", marker, i)), value(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// neither the keys nor the values are found in the log and hint files
+	infos, err := ioutil.ReadDir(dbPath)
+	assert.Nil(t, err)
+	for _, info := range infos {
+		raw, err := ioutil.ReadFile(filepath.Join(dbPath, info.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(raw, marker), info.Name())
+	}
+
+	for _, key := range [][]byte{nil, keyB} {
+		opts.EncryptionKey = key
+		_, err = New(opts)
+		assert.Equal(t, ErrWrongEncryptionKey, err)
+	}
+	readOpts := *opts
+	readOpts.ReadOnly = true
+	_, err = New(&readOpts)
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+
+	opts.EncryptionKey = utils.RandBytes(20)
+	_, err = New(opts)
+	assert.NotNil(t, err)
+
+	// the check needs no key
+	reports, err := Verify(dbPath)
+	assert.Nil(t, err)
+	for _, report := range reports {
+		assert.False(t, report.Corrupted())
+	}
+
+	// rotated by the merges, keyA is needed until then
+	opts.EncryptionKey, opts.DecryptionKeys = keyB, [][]byte{keyA}
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Compact(context.Background()))
+	for _, fs := range db.Stats().Files {
+		assert.Equal(t, keyID(keyB), db.logFile(fs.FID).keyID)
+		assert.Equal(t, LogFileEncrypted|LogFileCompressed, db.logFile(fs.FID).Flags())
+	}
+	assert.Nil(t, db.Close())
+
+	opts.DecryptionKeys = nil
+	db, err = New(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("%s-key-%d", marker, i)))
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(value(i), v))
+	}
+	archivedPath := db.logFile(db.Stats().Files[0].FID).Path()
+	assert.Nil(t, db.Close())
+
+	// the repair copies the entries left without decrypting them
+	f, err := os.OpenFile(archivedPath, os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 1000)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	opts.EncryptionKey = nil
+	reports, err = Repair(dbPath)
+	assert.Nil(t, err)
+	assert.True(t, reports[0].Corrupted())
+
+	opts.EncryptionKey = keyB
+	db, err = New(opts)
+	assert.Nil(t, err)
+	found := 0
+	for i := 0; i < 500; i++ {
+		if v, err := db.Get([]byte(fmt.Sprintf("%s-key-%d", marker, i))); err == nil {
+			assert.True(t, reflect.DeepEqual(value(i), v))
+			found++
+		}
+	}
+	assert.True(t, found >= 490)
+	assert.Nil(t, db.Close())
+}
+
+func TestEncryptionLegacy(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 500)
+	for i := 0; i < 500; i++ {
+		kv := utils.RandBytes(36)
+		kvs = append(kvs, kv)
+		assert.Nil(t, db.Put(kv, kv))
+	}
+	assert.Nil(t, db.Close())
+
+	// the files written before the encryption was enabled stay readable
+	opts.EncryptionKey = utils.RandBytes(32)
+	db, err = New(opts)
+	assert.Nil(t, err)
+	for _, kv := range kvs[:250] {
+		assert.Nil(t, db.Put(kv, kv))
+	}
+	for _, kv := range kvs {
+		v, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, v))
+	}
+
+	assert.Nil(t, db.Compact(context.Background()))
+	for _, fs := range db.Stats().Files {
+		assert.Equal(t, keyID(opts.EncryptionKey), db.logFile(fs.FID).keyID)
+	}
+	assert.Nil(t, db.Close())
+
+	key := opts.EncryptionKey
+	opts.EncryptionKey = nil
+	_, err = New(opts)
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+
+	// a read-only db follows the writer
+	opts.EncryptionKey = key
+	db, err = New(opts)
+	assert.Nil(t, err)
+	readOpts := *opts
+	readOpts.ReadOnly = true
+	reader, err := New(&readOpts)
+	assert.Nil(t, err)
+
+	kv := utils.RandBytes(36)
+	assert.Nil(t, db.Put(kv, kv))
+	assert.Nil(t, reader.Refresh())
+	v, err := reader.Get(kv)
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(kv, v))
+
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,238 @@
+package peach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// FormatJSONLines writes one JSON object per line, keys and values are
+	// base64 encoded.
+	FormatJSONLines ExportFormat = iota + 1
+	// FormatBinary writes a header followed by length-prefixed records.
+	FormatBinary
+
+	exportBinaryMagic = "PEACHEXP"
+	exportVersion     = 1
+
+	importBatchSize = 1024
+
+	// maxExportKeySize and maxExportValueSize bound the sizes read from a
+	// binary export, a corrupt stream fails instead of allocating them.
+	maxExportKeySize   = 1 << 20
+	maxExportValueSize = 1 << 30
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown export format")
+	ErrInvalidExport = errors.New("invalid export stream")
+)
+
+type (
+	ExportFormat uint8
+
+	// exportRecord is one key of an export, ExpiredAt is the unix time at
+	// which the key expires, 0 for a key without ttl.
+	exportRecord struct {
+		Key       []byte `json:"key"`
+		Value     []byte `json:"value"`
+		ExpiredAt int64  `json:"expired_at,omitempty"`
+	}
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case FormatJSONLines:
+		return "jsonl"
+	case FormatBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", uint8(f))
+	}
+}
+
+// ParseExportFormat returns the format named by String.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	for _, f := range []ExportFormat{FormatJSONLines, FormatBinary} {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return 0, ErrUnknownFormat
+}
+
+// Export writes every key of db with its value and expiration time to w. The
+// keys are read from a snapshot, writes go on during the export.
+func (db *DB) Export(w io.Writer, format ExportFormat) error {
+	bw := bufio.NewWriter(w)
+	enc, err := newExportEncoder(bw, format)
+	if err != nil {
+		return err
+	}
+
+	s, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+
+	it := s.NewIterator(IteratorOptions{})
+	defer it.Close()
+
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		rec := &exportRecord{Key: it.Key(), Value: value, ExpiredAt: it.expiredAt()}
+		if err := enc(rec); err != nil {
+			return err
+		}
+	}
+	if it.err != nil {
+		return it.err
+	}
+
+	return bw.Flush()
+}
+
+func newExportEncoder(w *bufio.Writer, format ExportFormat) (func(*exportRecord) error, error) {
+	switch format {
+	case FormatJSONLines:
+		enc := json.NewEncoder(w)
+		return func(rec *exportRecord) error {
+			return enc.Encode(rec)
+		}, nil
+	case FormatBinary:
+		if _, err := w.WriteString(exportBinaryMagic); err != nil {
+			return nil, err
+		}
+		if err := w.WriteByte(exportVersion); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 3*binary.MaxVarintLen64)
+		return func(rec *exportRecord) error {
+			n := binary.PutUvarint(buf, uint64(len(rec.Key)))
+			n += binary.PutUvarint(buf[n:], uint64(len(rec.Value)))
+			n += binary.PutVarint(buf[n:], rec.ExpiredAt)
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if _, err := w.Write(rec.Key); err != nil {
+				return err
+			}
+			_, err := w.Write(rec.Value)
+			return err
+		}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// Import writes the keys exported by DB.Export into db, in batches. The keys
+// which expired since the export are skipped.
+func Import(db *DB, r io.Reader, format ExportFormat) error {
+	br := bufio.NewReader(r)
+	dec, err := newExportDecoder(br, format)
+	if err != nil {
+		return err
+	}
+
+	b := NewBatch()
+	for {
+		rec, err := dec()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case rec.ExpiredAt == 0:
+			b.Put(rec.Key, rec.Value)
+		case rec.ExpiredAt > time.Now().Unix():
+			b.append(ExpiredAt, rec.ExpiredAt, rec.Key, rec.Value)
+		}
+
+		if b.Len() >= importBatchSize {
+			if err := db.Write(b); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+	return db.Write(b)
+}
+
+func newExportDecoder(r *bufio.Reader, format ExportFormat) (func() (*exportRecord, error), error) {
+	switch format {
+	case FormatJSONLines:
+		dec := json.NewDecoder(r)
+		return func() (*exportRecord, error) {
+			rec := &exportRecord{}
+			if err := dec.Decode(rec); err != nil {
+				return nil, err
+			}
+			if rec.Key == nil {
+				return nil, ErrInvalidExport
+			}
+			return rec, nil
+		}, nil
+	case FormatBinary:
+		header := make([]byte, len(exportBinaryMagic)+1)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, ErrInvalidExport
+		}
+		if !bytes.Equal(header[:len(exportBinaryMagic)], []byte(exportBinaryMagic)) || header[len(exportBinaryMagic)] != exportVersion {
+			return nil, ErrInvalidExport
+		}
+
+		return func() (*exportRecord, error) {
+			keySize, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, ErrInvalidExport
+			}
+			valueSize, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrInvalidExport
+			}
+			expiredAt, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, ErrInvalidExport
+			}
+
+			if keySize > maxExportKeySize || valueSize > maxExportValueSize {
+				return nil, ErrInvalidExport
+			}
+
+			// the buffer grows with the bytes read, not the sizes announced
+			size := int64(keySize + valueSize)
+			buf, err := io.ReadAll(io.LimitReader(r, size))
+			if err != nil || int64(len(buf)) != size {
+				return nil, ErrInvalidExport
+			}
+			return &exportRecord{Key: buf[:keySize], Value: buf[keySize:], ExpiredAt: expiredAt}, nil
+		}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
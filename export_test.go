@@ -0,0 +1,81 @@
+package peach
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	for _, format := range []ExportFormat{FormatJSONLines, FormatBinary} {
+		dbPath, importPath := "/tmp/peach", "/tmp/peach-import"
+		os.RemoveAll(dbPath)
+		os.RemoveAll(importPath)
+		db, err := New(DefaultOptions(dbPath))
+		assert.Nil(t, err)
+
+		kvs := make([][]byte, 0, 3000)
+		for i := 0; i < 3000; i++ {
+			kv := utils.RandBytes(36)
+			assert.Nil(t, db.Put(kv, kv))
+			kvs = append(kvs, kv)
+		}
+		assert.Nil(t, db.PutWithTTL([]byte("ttl"), []byte("v"), time.Hour))
+		assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("v"), -time.Second))
+		assert.Nil(t, db.Put([]byte("empty"), []byte{}))
+
+		var buf bytes.Buffer
+		assert.Nil(t, db.Export(&buf, format))
+		assert.Nil(t, db.Close())
+		assert.Equal(t, ErrUnknownFormat, db.Export(&buf, 0))
+
+		db, err = New(DefaultOptions(importPath))
+		assert.Nil(t, err)
+		assert.Nil(t, Import(db, &buf, format))
+		assert.Equal(t, int64(3002), db.Size())
+		for _, kv := range kvs {
+			value, err := db.Get(kv)
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(kv, value))
+		}
+		value, err := db.Get([]byte("empty"))
+		assert.Nil(t, err)
+		assert.Len(t, value, 0)
+		ttl, err := db.TTL([]byte("ttl"))
+		assert.Nil(t, err)
+		assert.InDelta(t, time.Hour, ttl, float64(2*time.Second))
+		ttl, err = db.TTL(kvs[0])
+		assert.Nil(t, err)
+		assert.Equal(t, NoExpiration, ttl)
+
+		assert.Equal(t, ErrInvalidExport, Import(db, bytes.NewReader([]byte("garbage")), FormatBinary))
+		for _, sizes := range [][2]uint64{
+			{math.MaxUint64, math.MaxUint64},
+			{1, math.MaxUint64},
+			{maxExportKeySize + 1, 0},
+			{maxExportKeySize, maxExportValueSize},
+		} {
+			header := make([]byte, 3*binary.MaxVarintLen64)
+			n := binary.PutUvarint(header, sizes[0])
+			n += binary.PutUvarint(header[n:], sizes[1])
+			n += binary.PutVarint(header[n:], 0)
+
+			stream := append([]byte(exportBinaryMagic), exportVersion)
+			stream = append(stream, header[:n]...)
+			stream = append(stream, "truncated"...)
+			assert.Equal(t, ErrInvalidExport, Import(db, bytes.NewReader(stream), FormatBinary))
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	format, err := ParseExportFormat("jsonl")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatJSONLines, format)
+}
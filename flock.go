@@ -14,8 +14,8 @@ func NewFlock(path string) *FileLock {
 	return &FileLock{path: path}
 }
 
-func (fl *FileLock) open() error {
-	f, err := os.OpenFile(fl.path, os.O_CREATE|os.O_RDONLY, os.ModePerm)
+func (fl *FileLock) open(flag int) error {
+	f, err := os.OpenFile(fl.path, flag, os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -24,11 +24,21 @@ func (fl *FileLock) open() error {
 }
 
 func (fl *FileLock) TryLock() error {
-	if err := fl.open(); err != nil {
+	return fl.tryLock(os.O_CREATE|os.O_RDONLY, syscall.LOCK_EX)
+}
+
+// TryRLock takes the lock shared with the other readers, the lock file is not
+// created when it does not exist.
+func (fl *FileLock) TryRLock() error {
+	return fl.tryLock(os.O_RDONLY, syscall.LOCK_SH)
+}
+
+func (fl *FileLock) tryLock(flag int, how int) error {
+	if err := fl.open(flag); err != nil {
 		return err
 	}
 
-	if err := syscall.Flock(int(fl.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+	if err := syscall.Flock(int(fl.file.Fd()), how|syscall.LOCK_NB); err != nil {
 		fl.file.Close()
 		return err
 	}
@@ -36,8 +46,20 @@ func (fl *FileLock) TryLock() error {
 }
 
 func (fl *FileLock) ULock() error {
+	if fl.file == nil {
+		return nil
+	}
 	if err := syscall.Flock(int(fl.file.Fd()), syscall.LOCK_UN|syscall.LOCK_NB); err != nil {
 		return nil
 	}
 	return fl.file.Close()
 }
+
+// createLockFile creates the lock file at path when it does not exist.
+func createLockFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -20,3 +20,22 @@ func TestFlock(t *testing.T) {
 	assert.Nil(t, flock.ULock())
 	assert.Nil(t, otherFlock.ULock())
 }
+
+func TestFlockShared(t *testing.T) {
+	fname := "/tmp/peach/READLOCK"
+	os.Remove(fname)
+
+	// the lock file is not created by the readers
+	assert.True(t, os.IsNotExist(NewFlock(fname).TryRLock()))
+	assert.Nil(t, createLockFile(fname))
+
+	flock := NewFlock(fname)
+	assert.Nil(t, flock.TryRLock())
+
+	otherFlock := NewFlock(fname)
+	assert.Nil(t, otherFlock.TryRLock())
+	assert.NotNil(t, NewFlock(fname).TryLock())
+
+	assert.Nil(t, flock.ULock())
+	assert.Nil(t, otherFlock.ULock())
+}
@@ -0,0 +1,296 @@
+package peach
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/muyisensen/peach/utils"
+)
+
+const (
+	HintFileNamePrefix = "hint."
+
+	hintFileTmpSuffix = ".tmp"
+	hintFlushSize     = 4096
+)
+
+var (
+	ErrInvalidHint = errors.New("invalid hint entry")
+)
+
+// A hint file holds one entry per committed entry of a sealed log file, in the
+// same order. It is encoded like a LogEntry whose value is the offset and the
+// size of the entry in the log file instead of the value, so the index can be
+// rebuilt without reading any value.
+
+type (
+	hintWriter struct {
+		lf      *LogFile
+		path    string
+		offset  int64
+		pending []*LogEntry
+	}
+)
+
+func hintFilePath(dirPath string, fid int) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%s%d", HintFileNamePrefix, fid))
+}
+
+// newHintWriter returns a writer of the hint file of the log file fid, the
+// hint file is encrypted with the current key of keys, if any.
+func newHintWriter(dirPath string, fid int, keys *keyRing) (*hintWriter, error) {
+	// every writer gets its own temporary file, a log file sealed at runtime
+	// may have its hint file written concurrently by two goroutines
+	path := hintFilePath(dirPath, fid)
+	tmp, err := ioutil.TempFile(dirPath, filepath.Base(path)+".*"+hintFileTmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+
+	lf, err := openLogFile(tmp.Name(), fid, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	w := &hintWriter{lf: lf, path: path}
+	if err := lf.writeHeader(keys); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	w.offset = lf.HeaderSize()
+
+	return w, nil
+}
+
+func (w *hintWriter) Add(le *LogEntry, offset int64, size int) error {
+	value := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(value, uint64(offset))
+	n += binary.PutUvarint(value[n:], uint64(size))
+
+	w.pending = append(w.pending, &LogEntry{
+		Type:      le.Type,
+		Timestamp: le.Timestamp,
+		Key:       le.Key,
+		Value:     value[:n],
+	})
+	if len(w.pending) < hintFlushSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *hintWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	sizes, err := w.lf.WriteAll(w.offset, w.pending)
+	if err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		w.offset += int64(size)
+	}
+	w.pending = w.pending[:0]
+
+	return nil
+}
+
+// Commit makes the hint file visible by renaming it once fully written.
+func (w *hintWriter) Commit() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(w.lf.Path(), w.path)
+}
+
+// Close flushes and closes the temporary file, which is removed on failure.
+func (w *hintWriter) Close() error {
+	if err := w.flush(); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if err := w.lf.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if err := w.lf.Close(); err != nil {
+		os.Remove(w.lf.Path())
+		return err
+	}
+
+	return nil
+}
+
+func (w *hintWriter) Abort() {
+	w.lf.Close()
+	os.Remove(w.lf.Path())
+}
+
+func decodeHint(le *LogEntry) (offset int64, size int, err error) {
+	o, n := binary.Uvarint(le.Value)
+	if n <= 0 {
+		return 0, 0, ErrInvalidHint
+	}
+
+	s, m := binary.Uvarint(le.Value[n:])
+	if m <= 0 || n+m != len(le.Value) {
+		return 0, 0, ErrInvalidHint
+	}
+
+	return int64(o), int(s), nil
+}
+
+// writeHintFile writes the hint file of a log file sealed at runtime. The hint
+// file is dropped when a merge replaced or removed the log file meanwhile.
+func (db *DB) writeHintFile(lf *LogFile) error {
+	w, err := newHintWriter(db.opts.DBPath, lf.FID(), db.keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = lf.Scan(w.Add)
+	if err == nil {
+		err = w.Close()
+	} else {
+		w.Abort()
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.archivedLogFile[lf.FID()] != lf {
+		os.Remove(w.lf.Path())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(w.lf.Path(), w.path)
+}
+
+func removeHintFile(dirPath string, fid int) error {
+	if err := os.Remove(hintFilePath(dirPath, fid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reloadArchived rebuilds the index from the hint file of a sealed log file,
+// the log file is replayed instead when its hint file is missing or broken
+// and a new hint file is written along the way.
+func (db *DB) reloadArchived(lf *LogFile) error {
+	err := db.reloadHint(lf.FID())
+	if err == nil {
+		return nil
+	}
+
+	// replaying entries already applied from a broken hint file is harmless,
+	// the log file holds the same entries in the same order
+	if !os.IsNotExist(err) {
+		log.Printf("reload hint file of %v fail, err msg: %v", lf.Path(), err.Error())
+	}
+
+	w, err := newHintWriter(db.opts.DBPath, lf.FID(), db.keys)
+	if err != nil {
+		return err
+	}
+
+	if offset, err := lf.Scan(func(le *LogEntry, offset int64, size int) error {
+		db.reloadEntry(le, lf.FID(), offset, size)
+		return w.Add(le, offset, size)
+	}); err != nil {
+		w.Abort()
+		if isCorrupted(err) {
+			return &CorruptedError{Path: lf.Path(), Offset: offset, Err: err}
+		}
+		return err
+	}
+
+	return w.Commit()
+}
+
+func (db *DB) reloadHint(fid int) error {
+	path := hintFilePath(db.opts.DBPath, fid)
+	if !utils.Exist(path) {
+		return os.ErrNotExist
+	}
+
+	hf, err := openLogFile(path, fid, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer hf.Close()
+
+	if err := hf.unlock(db.keys); err != nil {
+		return err
+	}
+
+	end, err := hf.Scan(func(le *LogEntry, _ int64, _ int) error {
+		offset, size, err := decodeHint(le)
+		if err != nil {
+			return err
+		}
+
+		le.Value = nil
+		db.reloadEntry(le, fid, offset, size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a hint file is renamed once complete, anything left over is garbage
+	size, err := hf.Size()
+	if err != nil {
+		return err
+	}
+	if end != size {
+		return ErrInvalidHint
+	}
+
+	return nil
+}
+
+// removeStaleHintFile removes the hint files which do not belong to an
+// archived log file, including the ones left half written.
+func (db *DB) removeStaleHintFile() error {
+	infos, err := ioutil.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), HintFileNamePrefix) {
+			continue
+		}
+
+		items := strings.Split(info.Name(), ".")
+		if len(items) == 2 {
+			if fid, err := strconv.Atoi(items[1]); err == nil {
+				if _, ok := db.archivedLogFile[fid]; ok {
+					continue
+				}
+			}
+		}
+
+		if err := os.Remove(filepath.Join(db.opts.DBPath, info.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
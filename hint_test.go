@@ -0,0 +1,62 @@
+package peach
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHintFile(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	for _, kv := range kvs[:500] {
+		assert.Nil(t, db.Delete(kv))
+	}
+	assert.True(t, len(db.archivedLogFile) > 1)
+	fids := make([]int, 0, len(db.archivedLogFile))
+	for fid, lf := range db.archivedLogFile {
+		assert.Nil(t, db.writeHintFile(lf))
+		fids = append(fids, fid)
+	}
+	assert.Nil(t, db.Close())
+
+	// a broken hint file falls back to the log file and is rewritten
+	assert.Nil(t, os.WriteFile(hintFilePath(dbPath, fids[0]), []byte("broken hint file"), os.ModePerm))
+	// a hint file without log file is removed
+	assert.Nil(t, os.WriteFile(hintFilePath(dbPath, 1<<20), []byte{}, os.ModePerm))
+
+	for i := 0; i < 2; i++ {
+		db, err = New(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1500), db.Size(), i)
+		assert.False(t, utils.Exist(hintFilePath(dbPath, 1<<20)))
+		for _, fid := range fids {
+			assert.True(t, utils.Exist(hintFilePath(dbPath, fid)))
+		}
+
+		for _, kv := range kvs[:500] {
+			_, err := db.Get(kv)
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for _, kv := range kvs[500:] {
+			value, err := db.Get(kv)
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(kv, value))
+		}
+		assert.Nil(t, db.Close())
+	}
+}
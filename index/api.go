@@ -7,13 +7,17 @@ type (
 		Delete(key []byte) (deleted *MemValue)
 		Minimum() (key []byte, value *MemValue)
 		Maximum() (key []byte, value *MemValue)
-		Iterate() Iterator
+		Iterate(opts *IteratorOptions) Iterator
 		Size() int64
 	}
 
 	Iterator interface {
 		HasNext() bool
 		Next() (key []byte, value *MemValue)
+		// Seek moves the iterator to the first key greater than or equal to key.
+		Seek(key []byte)
+		// SeekForPrev moves the iterator to the last key less than or equal to key.
+		SeekForPrev(key []byte)
 	}
 )
 
@@ -25,3 +29,8 @@ type (
 		ExpiredAt *int64
 	}
 )
+
+// IsExpired reports whether the value is expired at now, a unix timestamp.
+func (v *MemValue) IsExpired(now int64) bool {
+	return v.ExpiredAt != nil && *v.ExpiredAt <= now
+}
@@ -4,86 +4,259 @@ import (
 	"bytes"
 
 	"github.com/muyisensen/peach/index"
-	"github.com/muyisensen/peach/utils"
 )
 
 type (
+	// iterator walks the tree in depth-first order. The key of the current path
+	// is kept in one buffer, it grows by a node prefix when descending and is
+	// truncated when going back up, so a step only allocates the returned key.
 	iterator struct {
-		stack    *utils.SimpleStack
-		nextLeaf treeNode
+		tree      *tree
+		opts      index.IteratorOptions
+		frames    []frame
+		path      []byte
+		nextKey   []byte
+		nextValue *index.MemValue
 	}
 
-	packet struct {
-		node    treeNode
-		visited bool
+	// frame is a visited inner node, idx is the next child to visit and pathLen
+	// the length of path before the node prefix was appended.
+	frame struct {
+		children []treeNode
+		idx      int
+		pathLen  int
 	}
 )
 
 var _ index.Iterator = &iterator{}
 
-func newIterator(t *tree) *iterator {
-	stack := utils.NewSimpleStack(128)
-	stack.Push(&packet{node: *(t.root), visited: false})
-	return &iterator{stack: stack}
+func newIterator(t *tree, opts index.IteratorOptions) *iterator {
+	i := &iterator{
+		tree:   t,
+		opts:   opts,
+		frames: make([]frame, 0, 16),
+	}
+
+	switch {
+	case !opts.Reverse && opts.LowerBound != nil:
+		i.seekGE(opts.LowerBound)
+	case opts.Reverse && opts.UpperBound != nil:
+		i.seekLE(opts.UpperBound)
+	default:
+		i.rewind()
+	}
+
+	return i
 }
 
 func (i *iterator) HasNext() bool {
-	i.nextLeaf = nil
-	for i.stack.Size() > 0 {
-		elem := i.stack.Pop()
-		p, ok := elem.(*packet)
-		if !ok {
-			continue
+	i.nextKey, i.nextValue = nil, nil
+	for {
+		leaf := i.advance()
+		if leaf == nil {
+			return false
 		}
 
-		if isNil(p.node) {
-			continue
-		}
+		key := make([]byte, 0, len(i.path)+len(leaf.Key()))
+		key = append(append(key, i.path...), leaf.Key()...)
 
-		if p.node.Kind() == kindLeaf {
-			i.nextLeaf = p.node
-			break
+		lower, upper := i.opts.LowerBound, i.opts.UpperBound
+		if !i.opts.Reverse {
+			if upper != nil && bytes.Compare(key, upper) >= 0 {
+				i.frames = i.frames[:0]
+				return false
+			}
+			if lower != nil && bytes.Compare(key, lower) < 0 {
+				continue
+			}
+		} else {
+			if lower != nil && bytes.Compare(key, lower) < 0 {
+				i.frames = i.frames[:0]
+				return false
+			}
+			if upper != nil && bytes.Compare(key, upper) >= 0 {
+				continue
+			}
 		}
 
-		if p.visited {
-			continue
-		}
+		i.nextKey, i.nextValue = key, leaf.Value()
+		return true
+	}
+}
 
-		p.visited = true
-		i.stack.Push(p)
-		children := p.node.ListAllChild()
-		for j := len(children) - 1; j >= 0; j-- {
-			i.stack.Push(&packet{node: children[j], visited: false})
-		}
+func (i *iterator) Next() (key []byte, value *index.MemValue) {
+	return i.nextKey, i.nextValue
+}
+
+func (i *iterator) Seek(key []byte) {
+	if lower := i.opts.LowerBound; lower != nil && bytes.Compare(key, lower) < 0 {
+		key = lower
 	}
 
-	return i.nextLeaf != nil
+	if !i.opts.Reverse {
+		i.seekGE(key)
+		return
+	}
+
+	// find the key in ascending order, then position on it in descending order
+	other := newIterator(i.tree, index.IteratorOptions{})
+	other.seekGE(key)
+	if !other.HasNext() {
+		i.frames = i.frames[:0]
+		return
+	}
+	i.seekLE(other.nextKey)
 }
 
-func (i *iterator) Next() (key []byte, value *index.MemValue) {
-	if isNil(i.nextLeaf) {
+func (i *iterator) SeekForPrev(key []byte) {
+	if i.opts.Reverse {
+		i.seekLE(key)
 		return
 	}
 
-	keys := make([][]byte, 0)
-	for _, item := range i.stack.All() {
-		elem := item
-		p, ok := elem.(*packet)
-		if !ok {
+	other := newIterator(i.tree, index.IteratorOptions{Reverse: true})
+	other.seekLE(key)
+	if !other.HasNext() {
+		i.frames = i.frames[:0]
+		return
+	}
+	i.seekGE(other.nextKey)
+}
+
+func (i *iterator) rewind() {
+	i.frames, i.path = i.frames[:0], i.path[:0]
+	i.nextKey, i.nextValue = nil, nil
+	if i.tree.root == nil || isNil(*i.tree.root) {
+		return
+	}
+
+	// the root is the only child of a virtual frame without prefix
+	root := frame{children: []treeNode{*i.tree.root}}
+	i.frames = append(i.frames, root)
+}
+
+func (i *iterator) push(no treeNode) {
+	children := no.ListAllChild()
+	idx := 0
+	if i.opts.Reverse {
+		idx = len(children) - 1
+	}
+
+	i.frames = append(i.frames, frame{children: children, idx: idx, pathLen: len(i.path)})
+	i.path = append(i.path, no.Key()...)
+}
+
+// advance returns the next leaf in the iteration order, path holds the key
+// of its parent.
+func (i *iterator) advance() treeNode {
+	step := 1
+	if i.opts.Reverse {
+		step = -1
+	}
+
+	for len(i.frames) > 0 {
+		f := &i.frames[len(i.frames)-1]
+		if f.idx < 0 || f.idx >= len(f.children) {
+			i.path = i.path[:f.pathLen]
+			i.frames = i.frames[:len(i.frames)-1]
 			continue
 		}
 
-		if isNil(p.node) {
+		child := f.children[f.idx]
+		f.idx += step
+		if isNil(child) {
 			continue
 		}
 
-		if p.node.Kind() != kindLeaf && p.visited {
-			keys = append(keys, p.node.Key())
+		if child.Kind() == kindLeaf {
+			return child
 		}
+		i.push(child)
 	}
 
-	keys = append(keys, i.nextLeaf.Key())
-	key, value = bytes.Join(keys, []byte{}), i.nextLeaf.Value()
+	return nil
+}
+
+// seekGE positions an ascending iterator so that the next leaf is the first
+// one greater than or equal to target.
+func (i *iterator) seekGE(target []byte) {
+	i.rewind()
+	for len(i.frames) > 0 {
+		f := &i.frames[len(i.frames)-1]
+		rest := target[len(i.path):]
 
-	return
+		var descend treeNode
+		j := 0
+		for ; j < len(f.children); j++ {
+			child := f.children[j]
+			if isNil(child) {
+				continue
+			}
+
+			cKey := child.Key()
+			n := minimum(len(cKey), len(rest))
+			c := bytes.Compare(cKey[:n], rest[:n])
+			if c < 0 {
+				continue
+			}
+			if c > 0 || len(cKey) > len(rest) {
+				break
+			}
+
+			// cKey is a prefix of rest
+			if child.Kind() == kindLeaf {
+				if len(cKey) == len(rest) {
+					break
+				}
+				continue
+			}
+			descend = child
+			break
+		}
+
+		if descend == nil {
+			f.idx = j
+			return
+		}
+		f.idx = j + 1
+		i.push(descend)
+	}
+}
+
+// seekLE positions a descending iterator so that the next leaf is the last
+// one less than or equal to target.
+func (i *iterator) seekLE(target []byte) {
+	i.rewind()
+	for len(i.frames) > 0 {
+		f := &i.frames[len(i.frames)-1]
+		rest := target[len(i.path):]
+
+		var descend treeNode
+		j := len(f.children) - 1
+		for ; j >= 0; j-- {
+			child := f.children[j]
+			if isNil(child) {
+				continue
+			}
+
+			cKey := child.Key()
+			n := minimum(len(cKey), len(rest))
+			c := bytes.Compare(cKey[:n], rest[:n])
+			if c > 0 || c == 0 && len(cKey) > len(rest) {
+				continue
+			}
+			if c < 0 || child.Kind() == kindLeaf {
+				break
+			}
+			descend = child
+			break
+		}
+
+		if descend == nil {
+			f.idx = j
+			return
+		}
+		f.idx = j - 1
+		i.push(descend)
+	}
 }
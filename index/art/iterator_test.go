@@ -2,6 +2,7 @@ package art
 
 import (
 	"bytes"
+	"math/rand"
 	"reflect"
 	"sort"
 	"testing"
@@ -66,7 +67,7 @@ func TestIterator(t *testing.T) {
 	}
 
 	sort.Sort(pairs(kv))
-	it := tree.Iterate()
+	it := tree.Iterate(nil)
 
 	i = 0
 	for it.HasNext() {
@@ -77,3 +78,113 @@ func TestIterator(t *testing.T) {
 		i++
 	}
 }
+
+func TestIteratorSeek(t *testing.T) {
+	tree := NewAdaptiveRadixTree(&index.AdaptiveRadixTreeOptions{
+		NodeLeafPoolSize: 8,
+		Node4PoolSize:    8,
+		Node16PoolSize:   8,
+		Node48PoolSize:   8,
+		Node256PoolSize:  8,
+	})
+
+	// short keys over a small alphabet share a lot of prefixes, some keys
+	// are prefixes of others
+	kv, exist := make([]*pair, 0, 500), make(map[string]struct{})
+	for len(kv) < 500 {
+		key := make([]byte, 1+rand.Intn(6))
+		for j := range key {
+			key[j] = "abc"[rand.Intn(3)]
+		}
+		if _, ok := exist[string(key)]; ok {
+			continue
+		}
+		exist[string(key)] = struct{}{}
+
+		value := &index.MemValue{FileID: len(kv)}
+		tree.Put(key, value)
+		kv = append(kv, &pair{key: key, value: value})
+	}
+	sort.Sort(pairs(kv))
+
+	collect := func(it index.Iterator) [][]byte {
+		keys := make([][]byte, 0)
+		for it.HasNext() {
+			k, _ := it.Next()
+			keys = append(keys, k)
+		}
+		return keys
+	}
+	expect := func(lower, upper []byte, reverse bool) [][]byte {
+		keys := make([][]byte, 0)
+		for _, p := range kv {
+			if lower != nil && bytes.Compare(p.key, lower) < 0 {
+				continue
+			}
+			if upper != nil && bytes.Compare(p.key, upper) >= 0 {
+				continue
+			}
+			keys = append(keys, p.key)
+		}
+		if reverse {
+			for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+				keys[i], keys[j] = keys[j], keys[i]
+			}
+		}
+		return keys
+	}
+
+	assert.Equal(t, expect(nil, nil, true), collect(tree.Iterate(&index.IteratorOptions{Reverse: true})))
+
+	targets := [][]byte{[]byte(""), []byte("a"), []byte("ab"), []byte("bbbbbbb"), []byte("c"), []byte("cd"), []byte("d")}
+	for _, target := range targets {
+		it := tree.Iterate(nil)
+		it.Seek(target)
+		assert.Equal(t, expect(target, nil, false), collect(it))
+
+		it = tree.Iterate(&index.IteratorOptions{Reverse: true})
+		it.SeekForPrev(target)
+		upper := append(append([]byte{}, target...), 0)
+		assert.Equal(t, expect(nil, upper, true), collect(it))
+
+		it = tree.Iterate(nil)
+		it.SeekForPrev(target)
+		got := collect(it)
+		all := expect(nil, upper, false)
+		if len(all) == 0 {
+			assert.Len(t, got, 0)
+		} else {
+			assert.Equal(t, expect(all[len(all)-1], nil, false), got)
+		}
+
+		it = tree.Iterate(&index.IteratorOptions{Reverse: true})
+		it.Seek(target)
+		got = collect(it)
+		all = expect(target, nil, false)
+		if len(all) == 0 {
+			assert.Len(t, got, 0)
+		} else {
+			assert.Equal(t, expect(nil, append(append([]byte{}, all[0]...), 0), true), got)
+		}
+	}
+
+	lower, upper := []byte("ab"), []byte("bc")
+	assert.Equal(t, expect(lower, upper, false), collect(tree.Iterate(&index.IteratorOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})))
+	assert.Equal(t, expect(lower, upper, true), collect(tree.Iterate(&index.IteratorOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+		Reverse:    true,
+	})))
+
+	it := tree.Iterate(&index.IteratorOptions{LowerBound: lower, UpperBound: upper})
+	it.Seek([]byte("a"))
+	assert.Equal(t, expect(lower, upper, false), collect(it))
+
+	empty := NewAdaptiveRadixTree(&index.AdaptiveRadixTreeOptions{})
+	it = empty.Iterate(nil)
+	it.Seek([]byte("a"))
+	assert.False(t, it.HasNext())
+}
@@ -26,7 +26,7 @@ func (t *tree) Get(key []byte) (value *index.MemValue) {
 	}
 
 	cp, depth := t.root, 0
-	for cp != nil {
+	for cp != nil && !isNil(*cp) {
 		var (
 			current = *cp
 			cKey    = current.Key()
@@ -134,7 +134,7 @@ func (t *tree) Delete(key []byte) (deleted *index.MemValue) {
 
 		depth += len(cKey)
 		p := current.FindChild(key[depth:])
-		if p == nil {
+		if p == nil || isNil(*p) {
 			return
 		}
 		child := *p
@@ -208,8 +208,11 @@ func (t *tree) Maximum() (key []byte, value *index.MemValue) {
 	return keys, node.Value()
 }
 
-func (t *tree) Iterate() index.Iterator {
-	return newIterator(t)
+func (t *tree) Iterate(opts *index.IteratorOptions) index.Iterator {
+	if opts == nil {
+		opts = &index.IteratorOptions{}
+	}
+	return newIterator(t, *opts)
 }
 
 func (t *tree) Size() int64 {
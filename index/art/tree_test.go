@@ -60,3 +60,26 @@ func TestTree(t *testing.T) {
 	assert.True(t, reflect.DeepEqual(maxKey, otherKey))
 	assert.True(t, reflect.DeepEqual(maxValue, value))
 }
+
+func TestTreeMissingPrefixKey(t *testing.T) {
+	tree := NewAdaptiveRadixTree(&index.AdaptiveRadixTreeOptions{
+		NodeLeafPoolSize: 8,
+		Node4PoolSize:    8,
+		Node16PoolSize:   8,
+		Node48PoolSize:   8,
+		Node256PoolSize:  8,
+	})
+
+	value := &index.MemValue{FileID: 1, Offset: 10, Size: 100}
+	assert.Nil(t, tree.Put([]byte("abc-10"), value))
+	assert.Nil(t, tree.Put([]byte("abc-11"), value))
+
+	// a missing key which is the prefix of stored keys
+	assert.Nil(t, tree.Get([]byte("abc-1")))
+	assert.Nil(t, tree.Delete([]byte("abc-1")))
+	assert.Equal(t, int64(2), tree.Size())
+
+	assert.True(t, reflect.DeepEqual(value, tree.Delete([]byte("abc-10"))))
+	assert.True(t, reflect.DeepEqual(value, tree.Delete([]byte("abc-11"))))
+	assert.Equal(t, int64(0), tree.Size())
+}
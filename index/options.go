@@ -7,3 +7,12 @@ type AdaptiveRadixTreeOptions struct {
 	Node48PoolSize   int
 	Node256PoolSize  int
 }
+
+type IteratorOptions struct {
+	// LowerBound is the inclusive lower bound of keys, nil means no bound.
+	LowerBound []byte
+	// UpperBound is the exclusive upper bound of keys, nil means no bound.
+	UpperBound []byte
+	// Reverse iterates the keys in descending order.
+	Reverse bool
+}
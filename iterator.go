@@ -0,0 +1,169 @@
+package peach
+
+import (
+	"bytes"
+)
+
+const (
+	// iteratorChunkSize is the number of keys an iterator reads at once, the
+	// read lock of DB is released in between.
+	iteratorChunkSize = 1024
+)
+
+type (
+	IteratorOptions struct {
+		// Prefix limits the iteration to keys starting with it.
+		Prefix []byte
+	}
+
+	// Iterator walks the keys of a snapshot in ascending order, it skips expired
+	// keys. The keys are read in chunks and the read lock of DB is only held
+	// while reading one, so DB methods may be called while iterating.
+	Iterator struct {
+		snap *Snapshot
+		// owned tells whether Close releases snap
+		owned bool
+		opts  IteratorOptions
+		items []iteratorItem
+		pos   int
+		// next is the key the following chunk starts at, nil once the last
+		// chunk has been read
+		next   []byte
+		closed bool
+		// err tells why the iteration has stopped early
+		err error
+	}
+
+	iteratorItem struct {
+		key       []byte
+		expiredAt int64
+	}
+)
+
+// NewIterator returns an iterator positioned at the first key, it reads from
+// a snapshot of db taken now. Close must be called to release it.
+func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	s, err := db.Snapshot()
+	if err != nil {
+		return &Iterator{closed: true, err: err}
+	}
+
+	it := s.NewIterator(opts)
+	it.owned = true
+	return it
+}
+
+// Scan calls fn for every key in [start, end) in ascending order until fn
+// returns false, a nil end means no upper bound.
+func (db *DB) Scan(start, end []byte, fn func(k, v []byte) bool) error {
+	return scan(db.NewIterator(IteratorOptions{}), start, end, fn)
+}
+
+// PrefixScan calls fn for every key starting with prefix in ascending order
+// until fn returns false.
+func (db *DB) PrefixScan(prefix []byte, fn func(k, v []byte) bool) error {
+	return scan(db.NewIterator(IteratorOptions{Prefix: prefix}), prefix, nil, fn)
+}
+
+func scan(it *Iterator, start, end []byte, fn func(k, v []byte) bool) error {
+	defer it.Close()
+
+	if it.closed {
+		return it.err
+	}
+
+	for it.Seek(start); it.Valid(); it.Next() {
+		if end != nil && bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+
+		value, err := it.Value()
+		if err == ErrKeyNotFound {
+			// expired since its chunk was read
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !fn(it.Key(), value) {
+			break
+		}
+	}
+
+	return it.err
+}
+
+// Seek moves the iterator to the first key greater than or equal to key.
+func (it *Iterator) Seek(key []byte) {
+	if it.closed {
+		return
+	}
+
+	if bytes.Compare(key, it.opts.Prefix) < 0 {
+		key = it.opts.Prefix
+	}
+	it.items, it.pos, it.err = nil, 0, nil
+	it.next = append([]byte{}, key...)
+	it.load()
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+
+	it.pos++
+	it.load()
+}
+
+// load reads the following chunk once the current one is consumed.
+func (it *Iterator) load() {
+	for it.pos >= len(it.items) && it.next != nil {
+		it.items, it.next, it.err = it.snap.chunk(it.next, it.opts.Prefix, iteratorChunkSize)
+		it.pos = 0
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return !it.closed && it.pos < len(it.items)
+}
+
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.items[it.pos].key
+}
+
+// Value reads the value of the current key at the time of the snapshot.
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.Valid() {
+		return nil, ErrKeyNotFound
+	}
+	return it.snap.Get(it.items[it.pos].key)
+}
+
+// expiredAt returns the unix time at which the current key expires, 0 for a
+// key without ttl.
+func (it *Iterator) expiredAt() int64 {
+	if !it.Valid() {
+		return 0
+	}
+	return it.items[it.pos].expiredAt
+}
+
+// Close releases the iterator, and its snapshot when it was returned by
+// DB.NewIterator. It is safe to call it more than once.
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+
+	it.closed = true
+	it.items = nil
+	if it.owned {
+		it.snap.Release()
+	}
+}
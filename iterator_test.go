@@ -0,0 +1,97 @@
+package peach
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%03d-%d", i%100, i))
+		assert.Nil(t, db.Put(key, []byte("garbage")))
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		assert.Nil(t, db.Put(key, key))
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("key-expired"), []byte("v"), -time.Second))
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	it := db.NewIterator(IteratorOptions{})
+	got := make([][]byte, 0, len(keys))
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(it.Key(), value))
+		got = append(got, it.Key())
+	}
+	assert.True(t, reflect.DeepEqual(keys, got))
+
+	it.Seek([]byte("key-050"))
+	assert.True(t, it.Valid())
+	assert.True(t, reflect.DeepEqual(keys[500], it.Key()))
+	it.Close()
+	it.Close()
+	assert.False(t, it.Valid())
+
+	got = got[:0]
+	assert.Nil(t, db.Scan([]byte("key-010"), []byte("key-012"), func(k, v []byte) bool {
+		got = append(got, k)
+		return true
+	}))
+	assert.True(t, reflect.DeepEqual(keys[100:120], got))
+
+	got = got[:0]
+	assert.Nil(t, db.PrefixScan([]byte("key-099"), func(k, v []byte) bool {
+		got = append(got, k)
+		return len(got) < 5
+	}))
+	assert.True(t, reflect.DeepEqual(keys[990:995], got))
+
+	// no lock is held by fn, it may read and write while another write waits
+	got = got[:0]
+	assert.Nil(t, db.PrefixScan([]byte("key-000"), func(k, v []byte) bool {
+		done := make(chan error)
+		go func() {
+			done <- db.Put(append(k, '+'), v)
+		}()
+		time.Sleep(time.Millisecond)
+
+		value, err := db.Get(k)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(v, value))
+
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("write blocked by scan")
+		}
+		got = append(got, k)
+		return true
+	}))
+	// the keys written meanwhile are not seen
+	assert.True(t, reflect.DeepEqual(keys[:10], got))
+
+	assert.Nil(t, db.Put([]byte("key-1000"), []byte("v")))
+	assert.Nil(t, db.Close())
+	assert.False(t, db.NewIterator(IteratorOptions{}).Valid())
+	assert.Equal(t, ErrDBClosed, db.Scan(nil, nil, func(k, v []byte) bool { return true }))
+}
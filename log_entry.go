@@ -1,8 +1,10 @@
 package peach
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 )
 
@@ -23,27 +25,65 @@ const (
 	Normal LogEntryType = iota + 1
 	Delete
 	ExpiredAt
+	BatchBegin
+	BatchCommit
 )
 
 var (
 	ErrRawSizeTooShort  = errors.New("raw data size too short to decode")
 	ErrCheckSumNotMatch = errors.New("crc check sum not match")
+	ErrInvalidHeader    = errors.New("invalid log entry header")
 )
 
+func (t LogEntryType) String() string {
+	switch t {
+	case Normal:
+		return "normal"
+	case Delete:
+		return "delete"
+	case ExpiredAt:
+		return "expired_at"
+	case BatchBegin:
+		return "batch_begin"
+	case BatchCommit:
+		return "batch_commit"
+	default:
+		return fmt.Sprintf("LogEntryType(%d)", uint8(t))
+	}
+}
+
 func Encode(le *LogEntry) []byte {
+	return encode(le, CompressionNone, le.Value, nil, nil)
+}
+
+// encode writes value, the value of le compressed with c, in place of it.
+// Unless aead is nil the key and the value are encrypted, the key size field
+// still holds the size of the plain key.
+func encode(le *LogEntry, c Compression, value []byte, aead cipher.AEAD, noncePrefix []byte) []byte {
 	header := make([]byte, MaxLogEntryHeaderSize)
 
+	valueSize := len(value)
+	if aead != nil {
+		valueSize += nonceSuffixSize + aead.Overhead()
+	}
+
 	index := 5
 	index += binary.PutUvarint(header[index:], uint64(len(le.Key)))
-	index += binary.PutUvarint(header[index:], uint64(len(le.Value)))
+	index += binary.PutUvarint(header[index:], uint64(valueSize))
 	index += binary.PutUvarint(header[index:], uint64(le.Timestamp))
-	header[4] = byte(le.Type)
+	header[4] = byte(le.Type) | byte(c)<<compressionShift
 
-	size := index + len(le.Key) + len(le.Value)
+	size := index + len(le.Key) + valueSize
 	buf := make([]byte, size)
-	copy(buf[:index], header)
-	copy(buf[index:index+len(le.Key)], le.Key)
-	copy(buf[index+len(le.Key):], le.Value)
+	if aead == nil {
+		copy(buf[:index], header)
+		copy(buf[index:index+len(le.Key)], le.Key)
+		copy(buf[index+len(le.Key):], value)
+	} else {
+		header[4] |= entryEncrypted
+		copy(buf[:index], header)
+		copy(buf[index:], seal(aead, noncePrefix, buf[4:index], le.Key, value))
+	}
 
 	crc := crc32.ChecksumIEEE(buf[4:])
 	binary.LittleEndian.PutUint32(buf[:4], crc)
@@ -52,6 +92,12 @@ func Encode(le *LogEntry) []byte {
 }
 
 func Decode(raw []byte) (*LogEntry, error) {
+	return decode(raw, nil, nil)
+}
+
+// decode is Decode which decrypts the entries encrypted with aead, the ones
+// encrypted without it fail with ErrWrongEncryptionKey.
+func decode(raw []byte, aead cipher.AEAD, noncePrefix []byte) (*LogEntry, error) {
 	if len(raw) < 4 {
 		return nil, ErrRawSizeTooShort
 	}
@@ -62,20 +108,52 @@ func Decode(raw []byte) (*LogEntry, error) {
 		return nil, ErrCheckSumNotMatch
 	}
 
-	index := 5
-	keySize, n := binary.Uvarint(raw[index:])
-	index += n
+	if len(raw) < 5 {
+		return nil, ErrRawSizeTooShort
+	}
 
-	valueSize, n := binary.Uvarint(raw[index:])
-	index += n
+	var (
+		index  = 5
+		fields [3]uint64
+	)
+	for i := range fields {
+		v, n := binary.Uvarint(raw[index:])
+		if n <= 0 {
+			return nil, ErrInvalidHeader
+		}
+		fields[i] = v
+		index += n
+	}
 
-	timestamp, n := binary.Uvarint(raw[index:])
-	index += n
+	keySize, valueSize, timestamp := fields[0], fields[1], fields[2]
+	if keySize > uint64(len(raw)) || valueSize > uint64(len(raw)) ||
+		index+int(keySize)+int(valueSize) > len(raw) {
+		return nil, ErrRawSizeTooShort
+	}
+
+	key := raw[index : index+int(keySize)]
+	value := raw[index+int(keySize) : index+int(keySize)+int(valueSize)]
+	if raw[4]&entryEncrypted != 0 {
+		plain, err := open(aead, noncePrefix, raw[4:index], raw[index:index+int(keySize)+int(valueSize)])
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(plain)) < keySize {
+			return nil, ErrInvalidHeader
+		}
+		key, value = plain[:keySize], plain[keySize:]
+	}
+	if c := Compression(raw[4] >> compressionShift & compressionMask); c != CompressionNone {
+		var err error
+		if value, err = decompress(c, value); err != nil {
+			return nil, err
+		}
+	}
 
 	return &LogEntry{
-		Type:      LogEntryType(raw[4]),
+		Type:      LogEntryType(raw[4] & entryTypeMask),
 		Timestamp: int64(timestamp),
-		Key:       raw[index : index+int(keySize)],
-		Value:     raw[index+int(keySize) : index+int(keySize)+int(valueSize)],
+		Key:       key,
+		Value:     value,
 	}, nil
 }
@@ -3,8 +3,10 @@ package peach
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const (
@@ -12,22 +14,105 @@ const (
 )
 
 type (
+	// CorruptedError reports an entry of a log file which can not be decoded.
+	CorruptedError struct {
+		Path   string
+		Offset int64
+		Err    error
+	}
+
 	LogFile struct {
 		fid  int
 		path string
 		file *os.File
 		size int64
+		// live is the number of bytes of the entries still referenced by the
+		// index, the rest of the file is garbage
+		live int64
+		// pins is the number of snapshots reading the file, guarded by DB.mu
+		pins int
+		// codec encodes the entries written to the file
+		codec entryCodec
+		// start is the size of the header of the file, the first entry follows
+		// it, keyID is the id of the key encrypting the file, 0 for none
+		start     int64
+		version   uint16
+		flags     uint16
+		createdAt int64
+		keyID     uint32
 	}
 )
 
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("log file %v corrupted at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptedError) Unwrap() error {
+	return e.Err
+}
+
+// isCorrupted reports whether err comes from decoding a broken entry, as left
+// behind by a torn write or bit rot.
+func isCorrupted(err error) bool {
+	switch err {
+	case io.ErrUnexpectedEOF, ErrCheckSumNotMatch, ErrInvalidHeader, ErrRawSizeTooShort, ErrInvalidCompression:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewLogFile opens the log file fid of dirPath, creating it along with its
+// header when it does not exist.
 func NewLogFile(dirPath string, fid int) (*LogFile, error) {
-	fileName := fmt.Sprintf("%s%d", LogFileNamePrefix, fid)
-	path := filepath.Join(dirPath, fileName)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	lf, err := openLogFile(logFilePath(dirPath, fid), fid, os.O_CREATE|os.O_RDWR)
 	if err != nil {
 		return nil, err
 	}
-	return &LogFile{file: file, fid: fid, path: path}, nil
+
+	if err := lf.prepare(nil); err != nil {
+		lf.Close()
+		return nil, err
+	}
+	return lf, nil
+}
+
+// OpenLogFile opens the log file at path read-only, nothing is written to it.
+func OpenLogFile(path string, fid int) (*LogFile, error) {
+	return openLogFile(path, fid, os.O_RDONLY)
+}
+
+func logFilePath(dirPath string, fid int) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%s%d", LogFileNamePrefix, fid))
+}
+
+func openLogFile(path string, fid int, flag int) (*LogFile, error) {
+	f, err := openFile(path, fid, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openFile opens the log file at path without reading its header.
+func openFile(path string, fid int, flag int) (*LogFile, error) {
+	file, err := os.OpenFile(path, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &LogFile{file: file, fid: fid, path: path, size: stat.Size()}, nil
 }
 
 func (f *LogFile) Read(offset int64, size int) (*LogEntry, error) {
@@ -37,53 +122,162 @@ func (f *LogFile) Read(offset int64, size int) (*LogEntry, error) {
 		return nil, err
 	}
 
-	return Decode(buf)
+	return f.codec.decode(buf)
 }
 
+// Load reads the entry at offset without knowing its size. It returns io.EOF
+// when offset is the end of the file and io.ErrUnexpectedEOF when the entry
+// is cut short by the end of the file.
 func (f *LogFile) Load(offset int64) (*LogEntry, int, error) {
-	header := make([]byte, MaxLogEntryHeaderSize)
-	_, err := f.file.ReadAt(header, offset)
+	buf, err := f.loadRaw(offset)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	index := 5
-	keySize, n := binary.Uvarint(header[index:])
-	index += n
-
-	valueSize, n := binary.Uvarint(header[index:])
-	index += n
-
-	_, n = binary.Uvarint(header[index:])
-	index += n
-
-	kvBuf := make([]byte, keySize+valueSize)
-	_, err = f.file.ReadAt(kvBuf, offset+int64(index))
+	le, err := f.codec.decode(buf)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	buf := make([]byte, 0, index+int(keySize)+int(valueSize))
-	buf = append(buf, header[:index]...)
-	buf = append(buf, kvBuf...)
+	return le, len(buf), nil
+}
 
-	le, err := Decode(buf)
+// loadRaw reads the encoded entry at offset, see Load.
+func (f *LogFile) loadRaw(offset int64) ([]byte, error) {
+	fileSize, err := f.Size()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	if offset >= fileSize {
+		return nil, io.EOF
 	}
 
-	return le, len(buf), nil
+	header := make([]byte, MaxLogEntryHeaderSize)
+	hn, err := f.file.ReadAt(header, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if hn <= 5 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header = header[:hn]
+
+	index := 5
+	for i := 0; i < 3; i++ {
+		_, n := binary.Uvarint(header[index:])
+		if n <= 0 {
+			if hn < MaxLogEntryHeaderSize {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, ErrInvalidHeader
+		}
+		index += n
+	}
+
+	keySize, n := binary.Uvarint(header[5:])
+	valueSize, _ := binary.Uvarint(header[5+n:])
+	if keySize > uint64(fileSize) || valueSize > uint64(fileSize) ||
+		offset+int64(index)+int64(keySize)+int64(valueSize) > fileSize {
+		return nil, io.ErrUnexpectedEOF
+	}
 
+	buf := make([]byte, index+int(keySize)+int(valueSize))
+	copy(buf, header[:index])
+	if _, err = f.file.ReadAt(buf[index:], offset+int64(index)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Scan calls fn for every committed entry of the file in order, the entries
+// of a batch are only passed once its commit marker has been read. It returns
+// the offset following the last committed entry, also when an error occurs.
+func (f *LogFile) Scan(fn func(le *LogEntry, offset int64, size int) error) (int64, error) {
+	return f.scanFrom(f.start, fn)
+}
+
+// scanFrom is Scan starting at offset, which must be the offset of an entry
+// outside of a batch.
+func (f *LogFile) scanFrom(offset int64, fn func(le *LogEntry, offset int64, size int) error) (int64, error) {
+	type loaded struct {
+		le     *LogEntry
+		offset int64
+		size   int
+	}
+
+	var (
+		batchOffset = int64(-1)
+		pending     []loaded
+	)
+	for {
+		committed := offset
+		if batchOffset >= 0 {
+			committed = batchOffset
+		}
+
+		le, size, err := f.Load(offset)
+		switch err {
+		case nil:
+		case io.EOF:
+			// an uncommitted batch is dropped, it will be overwritten by the next write
+			return committed, nil
+		default:
+			return committed, err
+		}
+
+		switch {
+		case le.Type == BatchBegin:
+			batchOffset, pending = offset, pending[:0]
+		case le.Type == BatchCommit:
+			for _, item := range pending {
+				if err := fn(item.le, item.offset, item.size); err != nil {
+					return item.offset, err
+				}
+			}
+			batchOffset, pending = -1, pending[:0]
+		case batchOffset >= 0:
+			pending = append(pending, loaded{le: le, offset: offset, size: size})
+		default:
+			if err := fn(le, offset, size); err != nil {
+				return offset, err
+			}
+		}
+		offset += int64(size)
+	}
 }
 
 func (f *LogFile) Write(offset int64, le *LogEntry) (int, error) {
-	buf := Encode(le)
+	return f.writeAt(f.codec.encode(le), offset)
+}
+
+// WriteAll encodes les into one buffer and writes it with a single call,
+// it returns the encoded size of every entry.
+func (f *LogFile) WriteAll(offset int64, les []*LogEntry) ([]int, error) {
+	sizes, buf := make([]int, 0, len(les)), make([]byte, 0)
+	for _, le := range les {
+		raw := f.codec.encode(le)
+		sizes = append(sizes, len(raw))
+		buf = append(buf, raw...)
+	}
 
+	if _, err := f.writeAt(buf, offset); err != nil {
+		return nil, err
+	}
+
+	return sizes, nil
+}
+
+// writeAt writes the encoded buf at offset.
+func (f *LogFile) writeAt(buf []byte, offset int64) (int, error) {
 	n, err := f.file.WriteAt(buf, offset)
 	if err != nil {
 		return 0, err
 	}
-	f.size += int64(n)
+	f.grow(offset + int64(n))
 
 	return n, nil
 }
@@ -104,16 +298,46 @@ func (f *LogFile) Path() string {
 	return f.path
 }
 
+// HeaderSize returns the size of the header of the file, the offset of its
+// first entry.
+func (f *LogFile) HeaderSize() int64 {
+	return f.start
+}
+
 func (f *LogFile) Size() (int64, error) {
-	if f.size > 0 {
-		return f.size, nil
+	return atomic.LoadInt64(&f.size), nil
+}
+
+// Truncate cuts the file down to size, it is used to drop a torn tail.
+func (f *LogFile) Truncate(size int64) error {
+	if err := f.file.Truncate(size); err != nil {
+		return err
 	}
+	atomic.StoreInt64(&f.size, size)
+	return nil
+}
+
+// LiveBytes returns the number of bytes still referenced by the index.
+func (f *LogFile) LiveBytes() int64 {
+	return atomic.LoadInt64(&f.live)
+}
 
+func (f *LogFile) addLive(delta int64) {
+	atomic.AddInt64(&f.live, delta)
+}
+
+// reloadSize picks up the bytes appended to the file by another process.
+func (f *LogFile) reloadSize() error {
 	stat, err := f.file.Stat()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	f.size = stat.Size()
+	f.grow(stat.Size())
+	return nil
+}
 
-	return f.size, nil
+func (f *LogFile) grow(end int64) {
+	if end > atomic.LoadInt64(&f.size) {
+		atomic.StoreInt64(&f.size, end)
+	}
 }
@@ -20,9 +20,10 @@ func TestLogFile(t *testing.T) {
 
 	size, err := lf.Size()
 	assert.Nil(t, err)
-	assert.Equal(t, int64(0), size)
+	assert.Equal(t, int64(logFileHeaderSize), size)
+	assert.Equal(t, LogFileVersion, lf.Version())
 
-	offset := int64(0)
+	offset := lf.HeaderSize()
 	les := make([]*LogEntry, 0, 1024)
 	vals := make([]*index.MemValue, 0, 1024)
 	exist := make(map[string]struct{})
@@ -71,7 +72,7 @@ func TestLogFile(t *testing.T) {
 		assert.True(t, reflect.DeepEqual(le, les[index]))
 	}
 
-	offset = int64(0)
+	offset = lf.HeaderSize()
 	les2 := make([]*LogEntry, 0, 1024)
 	for {
 		le, n, err := lf.Load(offset)
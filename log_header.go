@@ -0,0 +1,184 @@
+package peach
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	// logFileMagic starts the header of a log or hint file, the files written
+	// before the header existed have none and are of version 0.
+	logFileMagic = "PEACHLOG"
+	// LogFileVersion is the version of the format of the log files written,
+	// the files of a later version can not be opened.
+	LogFileVersion = 1
+	// logFileHeaderSize is the size of the magic, the version, the flags, the
+	// creation time, the key id, the nonce prefix and the crc of the header.
+	logFileHeaderSize = len(logFileMagic) + 2 + 2 + 8 + 4 + noncePrefixSize + 4
+
+	// LogFileEncrypted flags a log file whose entries are encrypted.
+	LogFileEncrypted = 1 << 0
+	// LogFileCompressed flags a log file whose values are compressed when
+	// they get smaller, as set by Options.Compression at its creation.
+	LogFileCompressed = 1 << 1
+)
+
+var (
+	ErrInvalidLogFileHeader      = errors.New("invalid log file header")
+	ErrUnsupportedLogFileVersion = errors.New("unsupported log file version")
+)
+
+// readHeader reads and validates the header of the file, if any. A broken
+// header fails with a *CorruptedError at offset 0.
+func (f *LogFile) readHeader() error {
+	buf := make([]byte, logFileHeaderSize)
+	n, err := f.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !hasLogFileMagic(buf[:n]) {
+		return nil
+	}
+
+	if err := f.parseHeader(buf[:n]); err != nil {
+		if err == ErrInvalidLogFileHeader {
+			return &CorruptedError{Path: f.path, Offset: 0, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// hasLogFileMagic reports whether buf starts with the magic, give or take a
+// few broken bytes, so that a broken header is not read as the entries of a
+// file without header.
+func hasLogFileMagic(buf []byte) bool {
+	if len(buf) < len(logFileMagic) {
+		return false
+	}
+
+	same := 0
+	for i := range logFileMagic {
+		if buf[i] == logFileMagic[i] {
+			same++
+		}
+	}
+	return same*2 >= len(logFileMagic)
+}
+
+func (f *LogFile) parseHeader(buf []byte) error {
+	if len(buf) < logFileHeaderSize || !bytes.Equal(buf[:len(logFileMagic)], []byte(logFileMagic)) {
+		return ErrInvalidLogFileHeader
+	}
+
+	crc := binary.LittleEndian.Uint32(buf[logFileHeaderSize-4:])
+	if crc != crc32.ChecksumIEEE(buf[:logFileHeaderSize-4]) {
+		return ErrInvalidLogFileHeader
+	}
+
+	index := len(logFileMagic)
+	version := binary.LittleEndian.Uint16(buf[index:])
+	flags := binary.LittleEndian.Uint16(buf[index+2:])
+	createdAt := int64(binary.LittleEndian.Uint64(buf[index+4:]))
+	keyID := binary.LittleEndian.Uint32(buf[index+12:])
+	if version == 0 || version > LogFileVersion {
+		return ErrUnsupportedLogFileVersion
+	}
+	if (flags&LogFileEncrypted != 0) != (keyID != 0) {
+		return ErrInvalidLogFileHeader
+	}
+
+	f.version, f.flags, f.createdAt, f.keyID = version, flags, createdAt, keyID
+	f.codec.noncePrefix = append([]byte{}, buf[index+16:index+16+noncePrefixSize]...)
+	f.start = int64(logFileHeaderSize)
+	return nil
+}
+
+// encodeLogFileHeader returns the header of a file of the current version.
+func encodeLogFileHeader(flags uint16, createdAt int64, keyID uint32, noncePrefix []byte) []byte {
+	buf := make([]byte, logFileHeaderSize)
+	index := copy(buf, logFileMagic)
+	binary.LittleEndian.PutUint16(buf[index:], LogFileVersion)
+	binary.LittleEndian.PutUint16(buf[index+2:], flags)
+	binary.LittleEndian.PutUint64(buf[index+4:], uint64(createdAt))
+	binary.LittleEndian.PutUint32(buf[index+12:], keyID)
+	copy(buf[index+16:], noncePrefix)
+	binary.LittleEndian.PutUint32(buf[logFileHeaderSize-4:], crc32.ChecksumIEEE(buf[:logFileHeaderSize-4]))
+	return buf
+}
+
+// writeHeader writes the header of an empty file, whose entries are encrypted
+// with the current key of keys, if any.
+func (f *LogFile) writeHeader(keys *keyRing) error {
+	var (
+		id     = keys.currentID()
+		flags  uint16
+		prefix = make([]byte, noncePrefixSize)
+	)
+	if id != 0 {
+		flags |= LogFileEncrypted
+		if _, err := rand.Read(prefix); err != nil {
+			return err
+		}
+	}
+	if f.codec.compression != CompressionNone {
+		flags |= LogFileCompressed
+	}
+	createdAt := time.Now().UnixNano()
+
+	if _, err := f.writeAt(encodeLogFileHeader(flags, createdAt, id, prefix), 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	f.version, f.flags, f.createdAt, f.keyID = LogFileVersion, flags, createdAt, id
+	f.codec.aead, f.codec.noncePrefix = nil, nil
+	if id != 0 {
+		f.codec.noncePrefix = prefix
+	}
+	f.start = int64(logFileHeaderSize)
+	return f.unlock(keys)
+}
+
+// prepare writes the header of an empty file or gets the key of an existing
+// one, the file is ready to be read and written with keys.
+func (f *LogFile) prepare(keys *keyRing) error {
+	if size, _ := f.Size(); size == 0 {
+		return f.writeHeader(keys)
+	}
+	return f.unlock(keys)
+}
+
+// outdated reports whether the file lacks the header of the current version
+// or is not encrypted with the current key of keys, the merges rewrite such
+// files.
+func (f *LogFile) outdated(keys *keyRing) bool {
+	return f.version < LogFileVersion || f.keyID != keys.currentID()
+}
+
+// Version returns the format version of the file, 0 for a file without
+// header.
+func (f *LogFile) Version() int {
+	return int(f.version)
+}
+
+// Flags returns the flags of the header of the file.
+func (f *LogFile) Flags() int {
+	return int(f.flags)
+}
+
+// CreatedAt returns the time the file was created, the zero time for a file
+// without header.
+func (f *LogFile) CreatedAt() time.Time {
+	if f.version == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, f.createdAt)
+}
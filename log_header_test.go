@@ -0,0 +1,188 @@
+package peach
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFileHeader(t *testing.T) {
+	os.Remove("/tmp/log.0")
+
+	lf, err := NewLogFile("/tmp", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, LogFileVersion, lf.Version())
+	assert.Equal(t, 0, lf.Flags())
+	assert.True(t, time.Since(lf.CreatedAt()) < time.Minute)
+	assert.Nil(t, lf.Close())
+
+	lf, err = NewLogFile("/tmp", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(logFileHeaderSize), lf.HeaderSize())
+	assert.Nil(t, lf.Close())
+
+	// a later version is refused, so is a broken header
+	f, err := os.OpenFile("/tmp/log.0", os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	buf := make([]byte, logFileHeaderSize)
+	copy(buf, logFileMagic)
+	binary.LittleEndian.PutUint16(buf[len(logFileMagic):], LogFileVersion+1)
+	binary.LittleEndian.PutUint32(buf[logFileHeaderSize-4:], crc32.ChecksumIEEE(buf[:logFileHeaderSize-4]))
+	_, err = f.WriteAt(buf, 0)
+	assert.Nil(t, err)
+	_, err = NewLogFile("/tmp", 0)
+	assert.Equal(t, ErrUnsupportedLogFileVersion, err)
+
+	_, err = f.WriteAt([]byte{0xff}, int64(len(logFileMagic)))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = NewLogFile("/tmp", 0)
+	var corrupted *CorruptedError
+	assert.True(t, errors.As(err, &corrupted))
+	assert.Equal(t, int64(0), corrupted.Offset)
+	assert.Equal(t, ErrInvalidLogFileHeader, corrupted.Err)
+}
+
+func TestLogFileHeaderCorruption(t *testing.T) {
+	dbPath := "/tmp/peach"
+	for _, key := range [][]byte{nil, utils.RandBytes(32)} {
+		os.RemoveAll(dbPath)
+		opts := DefaultOptions(dbPath)
+		opts.LogFileSizeThreshold = 4 << 10
+		opts.CompactionTrigger = 0
+		opts.EncryptionKey = key
+		db, err := New(opts)
+		assert.Nil(t, err)
+
+		kvs := make([][]byte, 0, 300)
+		for i := 0; i < 300; i++ {
+			kv := utils.RandBytes(36)
+			assert.Nil(t, db.Put(kv, kv))
+			kvs = append(kvs, kv)
+		}
+		assert.Nil(t, db.Close())
+
+		flip := func(offset int64) {
+			f, err := os.OpenFile(logFilePath(dbPath, 0), os.O_RDWR, os.ModePerm)
+			assert.Nil(t, err)
+			b := make([]byte, 1)
+			_, err = f.ReadAt(b, offset)
+			assert.Nil(t, err)
+			_, err = f.WriteAt([]byte{b[0] ^ 0xff}, offset)
+			assert.Nil(t, err)
+			assert.Nil(t, f.Close())
+		}
+		check := func() {
+			_, err := New(opts)
+			var corrupted *CorruptedError
+			assert.True(t, errors.As(err, &corrupted))
+			assert.Equal(t, logFilePath(dbPath, 0), corrupted.Path)
+			assert.Equal(t, int64(0), corrupted.Offset)
+
+			reports, err := Verify(dbPath)
+			assert.Nil(t, err)
+			assert.Equal(t, []CorruptRange{{Offset: 0, End: int64(logFileHeaderSize), Err: ErrInvalidLogFileHeader}}, reports[0].Corrupt)
+			assert.True(t, reports[0].Entries > 0)
+		}
+		reopen := func() {
+			db, err := New(opts)
+			assert.Nil(t, err)
+			for _, kv := range kvs {
+				value, err := db.Get(kv)
+				assert.Nil(t, err)
+				assert.True(t, reflect.DeepEqual(kv, value))
+			}
+			assert.Nil(t, db.Close())
+		}
+
+		// a broken magic is not mistaken for a file without header, the rest
+		// of the header is recovered
+		flip(1)
+		check()
+		_, err = Repair(dbPath)
+		assert.Nil(t, err)
+		reopen()
+
+		// a broken header is rebuilt, unless the file is encrypted
+		flip(int64(len(logFileMagic)) + 12)
+		check()
+		_, err = Repair(dbPath)
+		if key != nil {
+			assert.True(t, errors.Is(err, ErrLogFileHeaderLost))
+			continue
+		}
+		assert.Nil(t, err)
+		reopen()
+	}
+}
+
+func TestLogFileHeaderMigration(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	assert.Nil(t, os.MkdirAll(dbPath, os.ModePerm))
+
+	// log files written before the header existed
+	kvs := make([][]byte, 0, 300)
+	for fid := 0; fid < 3; fid++ {
+		lf, err := openLogFile(logFilePath(dbPath, fid), fid, os.O_CREATE|os.O_RDWR)
+		assert.Nil(t, err)
+
+		offset := int64(0)
+		for i := 0; i < 100; i++ {
+			kv := utils.RandBytes(36)
+			kvs = append(kvs, kv)
+			n, err := lf.Write(offset, &LogEntry{Type: Normal, Timestamp: time.Now().Unix(), Key: kv, Value: kv})
+			assert.Nil(t, err)
+			offset += int64(n)
+		}
+		assert.Nil(t, lf.Close())
+	}
+
+	// a stray file is not taken for a log file
+	assert.Nil(t, os.WriteFile(filepath.Join(dbPath, "log.x"), []byte("stray"), os.ModePerm))
+
+	opts := DefaultOptions(dbPath)
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+	for _, fs := range db.Stats().Files {
+		lf := db.logFile(fs.FID)
+		assert.Equal(t, fs.Actived, lf.Version() == LogFileVersion)
+	}
+	for _, kv := range kvs {
+		v, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, v))
+	}
+
+	// the merges upgrade the files without header
+	assert.Nil(t, db.Compact(context.Background()))
+	for _, fs := range db.Stats().Files {
+		assert.Equal(t, LogFileVersion, db.logFile(fs.FID).Version())
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	for _, kv := range kvs {
+		v, err := db.Get(kv)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, v))
+	}
+	reports, err := Verify(dbPath)
+	assert.Nil(t, err)
+	for _, report := range reports {
+		assert.False(t, report.Corrupted())
+	}
+	assert.Nil(t, db.Close())
+	assert.True(t, utils.Exist(filepath.Join(dbPath, "log.x")))
+}
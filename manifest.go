@@ -0,0 +1,233 @@
+package peach
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ManifestFileName = "MANIFEST"
+)
+
+type (
+	// manifest lists the log files making up the db, along with the merge in
+	// progress. It is replaced as a whole by renaming a new file over it, so a
+	// crash leaves either the old or the new content.
+	manifest struct {
+		Files []int       `json:"files"`
+		Merge *mergeState `json:"merge,omitempty"`
+		// Backup is only set in the manifest of a backup
+		Backup *backupInfo `json:"backup,omitempty"`
+	}
+
+	// mergeState describes a merge of Inputs into the merge file of Output.
+	// Once Done the merge file is complete and replaces the inputs, a reload
+	// finishes the replacement; otherwise the merge file is dropped.
+	mergeState struct {
+		Inputs []int `json:"inputs"`
+		Output int   `json:"output"`
+		Done   bool  `json:"done"`
+	}
+)
+
+func readManifest(dirPath string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dirPath, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func writeManifest(dirPath string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dirPath, ManifestFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dirPath, ManifestFileName)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return syncDir(dirPath)
+}
+
+// syncDir makes the creations, renames and removals in dirPath durable.
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// saveManifest writes the current log files and merge state, the write lock
+// must be held.
+func (db *DB) saveManifest() error {
+	m := &manifest{Merge: db.mergeState}
+	for fid := range db.archivedLogFile {
+		m.Files = append(m.Files, fid)
+	}
+	if db.activedLogFile != nil {
+		m.Files = append(m.Files, db.activedLogFile.FID())
+	}
+	sort.Ints(m.Files)
+
+	return writeManifest(db.opts.DBPath, m)
+}
+
+// loadManifest returns the ids of the log files to reload in order. A merge
+// interrupted by a crash is completed or dropped, depending on whether it was
+// done, and log files left behind by a merge are removed. A db written before
+// the manifest existed has every log file of its directory reloaded.
+func (db *DB) loadManifest() ([]int, error) {
+	m, err := readManifest(db.opts.DBPath)
+	if os.IsNotExist(err) {
+		return listLogFiles(db.opts.DBPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ms := m.Merge; ms != nil && ms.Done {
+		if err := db.finishMerge(ms); err != nil {
+			return nil, err
+		}
+		m.Files = replaceMergeInputs(m.Files, ms)
+	}
+
+	fids, err := listLogFiles(db.opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[int]struct{}, len(m.Files))
+	for _, fid := range m.Files {
+		listed[fid] = struct{}{}
+	}
+	for _, fid := range fids {
+		if _, ok := listed[fid]; ok {
+			continue
+		}
+		log.Printf("remove log file %d which is not in the manifest", fid)
+		if err := os.Remove(logFilePath(db.opts.DBPath, fid)); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Ints(m.Files)
+	return m.Files, nil
+}
+
+// finishMerge puts the merge file in place of the merge inputs, it may be
+// called again after a crash.
+func (db *DB) finishMerge(ms *mergeState) error {
+	if err := removeHintFile(db.opts.DBPath, ms.Output); err != nil {
+		return err
+	}
+
+	path := mergeFilePath(db.opts.DBPath, ms.Output)
+	if err := os.Rename(path, logFilePath(db.opts.DBPath, ms.Output)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, fid := range ms.Inputs {
+		if fid == ms.Output {
+			continue
+		}
+		if err := os.Remove(logFilePath(db.opts.DBPath, fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := removeHintFile(db.opts.DBPath, fid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceMergeInputs returns files without the merge inputs but the output.
+func replaceMergeInputs(files []int, ms *mergeState) []int {
+	inputs := make(map[int]struct{}, len(ms.Inputs))
+	for _, fid := range ms.Inputs {
+		inputs[fid] = struct{}{}
+	}
+
+	kept := make([]int, 0, len(files))
+	for _, fid := range files {
+		if _, ok := inputs[fid]; !ok || fid == ms.Output {
+			kept = append(kept, fid)
+		}
+	}
+	return kept
+}
+
+// parseLogFileName returns the id of the log file named name, which is the
+// name logFilePath gives it.
+func parseLogFileName(name string) (int, bool) {
+	if !strings.HasPrefix(name, LogFileNamePrefix) {
+		return 0, false
+	}
+
+	rest := strings.TrimPrefix(name, LogFileNamePrefix)
+	fid, err := strconv.Atoi(rest)
+	if err != nil || fid < 0 || strconv.Itoa(fid) != rest {
+		return 0, false
+	}
+	return fid, true
+}
+
+// listLogFiles returns the ids of the log files found in dirPath.
+func listLogFiles(dirPath string) ([]int, error) {
+	infos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fids := make([]int, 0, len(infos))
+	for _, info := range infos {
+		// a stray file such as log.x is not a log file
+		fid, ok := parseLogFileName(info.Name())
+		if !ok {
+			continue
+		}
+		fids = append(fids, fid)
+	}
+	sort.Ints(fids)
+
+	return fids, nil
+}
@@ -0,0 +1,128 @@
+package peach
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// crashMerge runs a merge until the merge file is complete and saves the
+// manifest with the merge done or not, then closes the db without completing
+// the merge, as a crash would.
+func crashMerge(t *testing.T, db *DB, done bool) *mergeState {
+	job, err := db.beginMerge()
+	assert.Nil(t, err)
+	assert.NotNil(t, job)
+	assert.Nil(t, job.run(context.Background()))
+	assert.Nil(t, job.out.Close())
+
+	db.mu.Lock()
+	ms := db.mergeState
+	ms.Done = done
+	assert.Nil(t, db.saveManifest())
+	db.mergeState = nil
+	db.inGc = false
+	db.mu.Unlock()
+	db.wg.Done()
+
+	assert.Nil(t, db.Close())
+	return ms
+}
+
+func TestManifestRecovery(t *testing.T) {
+	for _, done := range []bool{false, true} {
+		dbPath := "/tmp/peach"
+		os.RemoveAll(dbPath)
+		opts := DefaultOptions(dbPath)
+		opts.LogFileSizeThreshold = 64 << 10
+		opts.CompactionTrigger = 0
+		db, err := New(opts)
+		assert.Nil(t, err)
+
+		kvs := make([][]byte, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			kvs = append(kvs, utils.RandBytes(36))
+		}
+		for _, kv := range kvs {
+			assert.Nil(t, db.Put(kv, kv[:10]))
+		}
+		for _, kv := range kvs {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+		// the deletes hide the first entries, which live in another merge input
+		for _, kv := range kvs[:500] {
+			assert.Nil(t, db.Delete(kv))
+		}
+
+		ms := crashMerge(t, db, done)
+		assert.True(t, len(ms.Inputs) > 1)
+		assert.True(t, utils.Exist(mergeFilePath(dbPath, ms.Output)))
+
+		db, err = New(opts)
+		assert.Nil(t, err)
+		assert.False(t, utils.Exist(mergeFilePath(dbPath, ms.Output)))
+		for _, fid := range ms.Inputs {
+			assert.Equal(t, !done || fid == ms.Output, utils.Exist(logFilePath(dbPath, fid)))
+		}
+		m, err := readManifest(dbPath)
+		assert.Nil(t, err)
+		assert.Nil(t, m.Merge)
+
+		assert.Equal(t, int64(500), db.Size())
+		for _, kv := range kvs[:500] {
+			_, err := db.Get(kv)
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for _, kv := range kvs[500:] {
+			value, err := db.Get(kv)
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(kv, value))
+		}
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+		kvs = append(kvs, kv)
+	}
+	m, err := readManifest(dbPath)
+	assert.Nil(t, err)
+	assert.Len(t, m.Files, len(db.archivedLogFile)+1)
+	assert.Equal(t, db.activedLogFile.FID(), m.Files[len(m.Files)-1])
+	assert.Nil(t, db.Close())
+
+	// a log file missing from the manifest is a leftover of a merge
+	stray := logFilePath(dbPath, 1000)
+	assert.Nil(t, os.WriteFile(stray, Encode(&LogEntry{Type: Normal, Key: kvs[0], Value: []byte("stale")}), os.ModePerm))
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.False(t, utils.Exist(stray))
+	value, err := db.Get(kvs[0])
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(kvs[0], value))
+	assert.Nil(t, db.Close())
+
+	// a db without manifest reloads every log file
+	assert.Nil(t, os.Remove(filepath.Join(dbPath, ManifestFileName)))
+	db, err = New(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), db.Size())
+	assert.True(t, utils.Exist(filepath.Join(dbPath, ManifestFileName)))
+	assert.Nil(t, db.Close())
+}
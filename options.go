@@ -13,15 +13,60 @@ type (
 		LogFileGCInterval    time.Duration
 		LogFileSizeThreshold int64
 
+		// CompactionTrigger starts a gc once the ratio of dead bytes to total
+		// bytes of the log files reaches it, 0 disables it.
+		CompactionTrigger float64
+		// CompactionFileGarbageRatio is the garbage ratio from which a log file
+		// is rewritten by a gc, the others are kept as they are.
+		CompactionFileGarbageRatio float64
+		// CompactionBytesPerSecond bounds the bytes a merge reads from the log
+		// files and writes to the merge file per second, 0 means unlimited.
+		CompactionBytesPerSecond int64
+
+		// ReadOnly opens the db for reading alongside the process writing it,
+		// nothing is written to the db directory. See DB.Refresh.
+		ReadOnly bool
+
+		// ScrubInterval is the time between two scrubs of the sealed log files,
+		// see DB.Scrub. 0 disables the background scrub.
+		ScrubInterval time.Duration
+		// ScrubBytesPerSecond bounds the bytes a scrub reads per second, 0
+		// means unlimited.
+		ScrubBytesPerSecond int64
+		// OnCorruption is called with every corrupt range found by a scrub.
+		OnCorruption func(err *CorruptedError)
+
+		// Compression compresses the values of at least CompressionThreshold
+		// bytes written from now on, the log files keep any value readable.
+		Compression          Compression
+		CompressionThreshold int
+
+		// EncryptionKey encrypts the entries of the log and hint files created
+		// from now on with AES-GCM, it is 16, 24 or 32 bytes long. The files
+		// written with a former key are read with DecryptionKeys and rewritten
+		// with EncryptionKey by Compact, opening a file whose key is missing
+		// fails with ErrWrongEncryptionKey.
+		EncryptionKey  []byte
+		DecryptionKeys [][]byte
+
+		// SyncPolicy decides when writes are flushed to stable storage.
+		SyncPolicy SyncPolicy
+
 		ArtOpt *index.AdaptiveRadixTreeOptions
 	}
 )
 
 func DefaultOptions(dbPath string) *Options {
 	return &Options{
-		DBPath:               dbPath,
-		LogFileGCInterval:    5 * time.Hour,
-		LogFileSizeThreshold: 512 << 20,
+		DBPath:                     dbPath,
+		LogFileGCInterval:          5 * time.Hour,
+		LogFileSizeThreshold:       512 << 20,
+		CompactionTrigger:          0.5,
+		CompactionFileGarbageRatio: 0.3,
+		ScrubBytesPerSecond:        1 << 20,
+		Compression:                CompressionNone,
+		CompressionThreshold:       256,
+		SyncPolicy:                 SyncNone,
 		ArtOpt: &index.AdaptiveRadixTreeOptions{
 			NodeLeafPoolSize: 512,
 			Node4PoolSize:    256,
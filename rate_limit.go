@@ -0,0 +1,91 @@
+package peach
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// rateLimiter is a token bucket of bytes refilled at rate per second, the
+	// bucket holds at most one second worth of tokens. A caller may take more
+	// tokens than available, the following callers wait for the debt.
+	rateLimiter struct {
+		mu     sync.Mutex
+		rate   int64
+		tokens float64
+		last   time.Time
+	}
+)
+
+// newRateLimiter returns a limiter of rate bytes per second, 0 means unlimited.
+func newRateLimiter(rate int64) *rateLimiter {
+	l := &rateLimiter{}
+	l.setRate(rate)
+	return l
+}
+
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	if rate <= 0 || l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// wait blocks until n bytes may be read or written, it gives up when ctx is
+// done or done is closed.
+func (l *rateLimiter) wait(ctx context.Context, done <-chan struct{}, n int) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return ErrDBClosed
+	}
+}
+
+// SetCompactionRate changes the number of bytes per second a merge may read
+// and write, 0 means unlimited. It applies to the running merge.
+func (db *DB) SetCompactionRate(bytesPerSecond int64) {
+	db.compactionLimiter.setRate(bytesPerSecond)
+}
@@ -0,0 +1,339 @@
+package peach
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/muyisensen/peach/index/art"
+	"github.com/muyisensen/peach/utils"
+)
+
+const (
+	// readOnlyReloadRetries bounds the loads started over because the writer
+	// changed the log files meanwhile.
+	readOnlyReloadRetries = 10
+)
+
+var (
+	errManifestChanged = errors.New("manifest changed while loading the db")
+)
+
+// openReadOnly opens the db at opts.DBPath for reading. The writer keeps
+// running, the log files it seals or merges later are picked up by Refresh.
+func openReadOnly(opts *Options) (*DB, error) {
+	if _, err := os.Stat(opts.DBPath); err != nil {
+		return nil, err
+	}
+
+	db, err := newDB(opts, ReadLockFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lock file is created by the writer, the db is read without it
+	// until the writer opens it
+	if err := db.fileLock.TryRLock(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := db.reloadReadOnly(); err != nil {
+		db.fileLock.ULock()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Refresh picks up the writes made since a db opened with Options.ReadOnly
+// was opened or last refreshed. Once the writer merged log files the index
+// is rebuilt, closing the log files replaced by the merge, unless a snapshot
+// is open. It is a no-op for a writable db.
+func (db *DB) Refresh() error {
+	if !db.opts.ReadOnly {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	m, err := db.readOnlyManifest()
+	if err != nil {
+		return err
+	}
+
+	merged, err := db.replacedByMerge()
+	if err != nil {
+		return err
+	}
+	if merged && len(db.snapshots) == 0 {
+		return db.rebuildReadOnly()
+	}
+
+	return db.refreshTail(m)
+}
+
+// reloadReadOnly opens the log files listed by the manifest and rebuilds the
+// index, without changing anything in the db directory. The load starts over
+// when the manifest changed meanwhile, the writer sealed or merged log files.
+// The db is left empty on failure.
+func (db *DB) reloadReadOnly() error {
+	var err error
+	for i := 0; i < readOnlyReloadRetries; i++ {
+		var before, after *manifest
+		if before, err = db.readOnlyManifest(); err != nil {
+			return err
+		}
+
+		if err = db.loadReadOnly(before); err == nil {
+			if after, err = db.readOnlyManifest(); err != nil {
+				db.resetReadOnly()
+				return err
+			}
+			if reflect.DeepEqual(before, after) {
+				return nil
+			}
+			err = errManifestChanged
+		}
+
+		db.resetReadOnly()
+		// a log file removed by a merge after the manifest was read
+		if err != errManifestChanged && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// readOnlyManifest returns the manifest of the db, or one listing every log
+// file of a db written before the manifest existed.
+func (db *DB) readOnlyManifest() (*manifest, error) {
+	m, err := readManifest(db.opts.DBPath)
+	if os.IsNotExist(err) {
+		fids, err := listLogFiles(db.opts.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		return &manifest{Files: fids}, nil
+	}
+	return m, err
+}
+
+// readOnlyFiles returns the ids of the log files of m in order. A merge done
+// but not finished by the writer yet is taken as finished.
+func readOnlyFiles(m *manifest) []int {
+	fids := append([]int{}, m.Files...)
+	if ms := m.Merge; ms != nil && ms.Done {
+		fids = replaceMergeInputs(fids, ms)
+	}
+	sort.Ints(fids)
+	return fids
+}
+
+func (db *DB) loadReadOnly(m *manifest) error {
+	fids := readOnlyFiles(m)
+	for i, fid := range fids {
+		path, fromHint := logFilePath(db.opts.DBPath, fid), true
+		if ms := m.Merge; ms != nil && ms.Done && ms.Output == fid {
+			// the merge file is renamed over the log file once the merge is
+			// finished, the hint file may still describe the former one
+			if mergePath := mergeFilePath(db.opts.DBPath, fid); utils.Exist(mergePath) {
+				path = mergePath
+			}
+			fromHint = false
+		}
+
+		lf, err := db.openReadOnlyFile(path, fid)
+		if err != nil {
+			return err
+		}
+
+		if i < len(fids)-1 {
+			db.archivedLogFile[fid] = lf
+			if err := db.reloadSealed(lf, fromHint); err != nil {
+				return err
+			}
+			continue
+		}
+
+		db.activedLogFile = lf
+		if err := db.reloadTail(lf, lf.HeaderSize(), db.reloadEntry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openReadOnlyFile opens the log file at path for reading with the keys of the
+// options.
+func (db *DB) openReadOnlyFile(path string, fid int) (*LogFile, error) {
+	lf, err := openLogFile(path, fid, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lf.unlock(db.keys); err != nil {
+		lf.Close()
+		return nil, err
+	}
+	return lf, nil
+}
+
+// reloadSealed is reloadArchived without writing the missing hint files.
+func (db *DB) reloadSealed(lf *LogFile, fromHint bool) error {
+	if fromHint {
+		if err := db.reloadHint(lf.FID()); err == nil {
+			return nil
+		}
+	}
+
+	offset, err := lf.Scan(func(le *LogEntry, offset int64, size int) error {
+		db.reloadEntry(le, lf.FID(), offset, size)
+		return nil
+	})
+	if isCorrupted(err) {
+		return &CorruptedError{Path: lf.Path(), Offset: offset, Err: err}
+	}
+	return err
+}
+
+// reloadTail applies the entries of the active log file from offset on. The
+// writer may be appending to it, a torn entry at the end is read again by the
+// next Refresh.
+func (db *DB) reloadTail(lf *LogFile, offset int64, apply func(le *LogEntry, fid int, offset int64, size int)) error {
+	if err := lf.reloadSize(); err != nil {
+		return err
+	}
+
+	// the writer writes the header of an empty log file it reopens
+	if offset == 0 && lf.HeaderSize() == 0 {
+		if err := lf.readHeader(); err != nil {
+			return err
+		}
+		if err := lf.unlock(db.keys); err != nil {
+			return err
+		}
+		offset = lf.HeaderSize()
+	}
+
+	end, err := lf.scanFrom(offset, func(le *LogEntry, offset int64, size int) error {
+		apply(le, lf.FID(), offset, size)
+		return nil
+	})
+	if err != nil && !isCorrupted(err) {
+		return err
+	}
+
+	db.offset = end
+	return nil
+}
+
+// refreshTail applies the entries appended to the active log file, then the
+// ones of the log files created since. Snapshots keep the values they see.
+func (db *DB) refreshTail(m *manifest) error {
+	apply := func(le *LogEntry, fid int, offset int64, size int) {
+		db.captureSnapshots(le.Key)
+		db.reloadEntry(le, fid, offset, size)
+	}
+
+	// the manifest was read first, a log file sealed by then is complete
+	newest := -1
+	if db.activedLogFile != nil {
+		newest = db.activedLogFile.FID()
+		if err := db.reloadTail(db.activedLogFile, db.offset, apply); err != nil {
+			return err
+		}
+	}
+
+	for _, fid := range readOnlyFiles(m) {
+		if fid <= newest {
+			continue
+		}
+
+		lf, err := db.openReadOnlyFile(logFilePath(db.opts.DBPath, fid), fid)
+		if err != nil {
+			return err
+		}
+
+		if db.activedLogFile != nil {
+			db.archivedLogFile[db.activedLogFile.FID()] = db.activedLogFile
+		}
+		db.activedLogFile, db.offset = lf, lf.HeaderSize()
+		if err := db.reloadTail(lf, lf.HeaderSize(), apply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replacedByMerge reports whether a log file read by the db was removed or
+// rewritten by a merge since.
+func (db *DB) replacedByMerge() (bool, error) {
+	files := make([]*LogFile, 0, len(db.archivedLogFile)+1)
+	for _, lf := range db.archivedLogFile {
+		files = append(files, lf)
+	}
+	if db.activedLogFile != nil {
+		files = append(files, db.activedLogFile)
+	}
+
+	for _, lf := range files {
+		opened, err := lf.file.Stat()
+		if err != nil {
+			return false, err
+		}
+
+		current, err := os.Stat(lf.Path())
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !os.SameFile(opened, current) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// rebuildReadOnly reloads the db from scratch, it is kept as it was when the
+// reload fails.
+func (db *DB) rebuildReadOnly() error {
+	index0, size := db.index0, db.size
+	activedLogFile, offset, archivedLogFile := db.activedLogFile, db.offset, db.archivedLogFile
+
+	db.index0, db.size = art.NewAdaptiveRadixTree(db.opts.ArtOpt), 0
+	db.activedLogFile, db.offset, db.archivedLogFile = nil, 0, make(map[int]*LogFile)
+	if err := db.reloadReadOnly(); err != nil {
+		db.index0, db.size = index0, size
+		db.activedLogFile, db.offset, db.archivedLogFile = activedLogFile, offset, archivedLogFile
+		return err
+	}
+
+	for _, lf := range archivedLogFile {
+		lf.Close()
+	}
+	if activedLogFile != nil {
+		activedLogFile.Close()
+	}
+
+	return nil
+}
+
+// resetReadOnly closes the log files and empties the index.
+func (db *DB) resetReadOnly() {
+	db.closeLogFiles()
+	db.index0, db.size = art.NewAdaptiveRadixTree(db.opts.ArtOpt), 0
+	db.activedLogFile, db.offset = nil, 0
+	db.archivedLogFile = make(map[int]*LogFile)
+}
@@ -0,0 +1,118 @@
+package peach
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 0, 300)
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		assert.Nil(t, db.Put(key, key))
+		keys = append(keys, key)
+	}
+
+	// the read lock file is created by the writer
+	readLockPath := filepath.Join(dbPath, ReadLockFileName)
+	assert.True(t, utils.Exist(readLockPath))
+
+	roOpts := DefaultOptions(dbPath)
+	roOpts.ReadOnly = true
+	ro, err := New(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), ro.Size())
+	for _, key := range keys {
+		value, err := ro.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(key, value))
+	}
+
+	assert.Equal(t, ErrReadOnly, ro.Put(keys[0], keys[0]))
+	assert.Equal(t, ErrReadOnly, ro.Delete(keys[0]))
+	assert.Equal(t, ErrReadOnly, ro.Compact(context.Background()))
+	assert.Equal(t, ErrReadOnly, ro.Backup("/tmp/peach-backup"))
+
+	// appended entries and new log files
+	for i, key := range keys {
+		if i%2 == 0 {
+			assert.Nil(t, db.Put(key, []byte("new")))
+		} else {
+			assert.Nil(t, db.Delete(key))
+		}
+	}
+	_, err = ro.Get(keys[1])
+	assert.Nil(t, err)
+
+	s, err := ro.Snapshot()
+	assert.Nil(t, err)
+	assert.Nil(t, ro.Refresh())
+	assert.Equal(t, int64(150), ro.Size())
+	for i, key := range keys {
+		value, err := ro.Get(key)
+		if i%2 == 0 {
+			assert.True(t, reflect.DeepEqual([]byte("new"), value))
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+
+		value, err = s.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(key, value))
+	}
+
+	// the log files replaced by a merge are kept while the snapshot is open
+	assert.Nil(t, db.Compact(context.Background()))
+	assert.Nil(t, ro.Refresh())
+	value, err := s.Get(keys[1])
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(keys[1], value))
+	s.Release()
+
+	assert.Nil(t, db.Put(keys[1], []byte("new")))
+	assert.Nil(t, ro.Refresh())
+	merged, err := ro.replacedByMerge()
+	assert.Nil(t, err)
+	assert.False(t, merged)
+	assert.Equal(t, int64(151), ro.Size())
+	for i, key := range keys {
+		value, err := ro.Get(key)
+		if i%2 == 0 || i == 1 {
+			assert.True(t, reflect.DeepEqual([]byte("new"), value))
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+
+	assert.Nil(t, ro.Close())
+	assert.Nil(t, db.Close())
+
+	// a read-only db does not create the read lock file
+	assert.Nil(t, os.Remove(readLockPath))
+	ro, err = New(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(151), ro.Size())
+	assert.Nil(t, ro.Close())
+	assert.False(t, utils.Exist(readLockPath))
+
+	// nothing is created for a missing db
+	roOpts = DefaultOptions("/tmp/peach-missing")
+	roOpts.ReadOnly = true
+	_, err = New(roOpts)
+	assert.True(t, os.IsNotExist(err))
+}
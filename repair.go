@@ -0,0 +1,337 @@
+package peach
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// RepairFileNamePrefix names the log files being written by Repair.
+	RepairFileNamePrefix = "repair."
+	// CorruptFileNamePrefix names the log files replaced by Repair, they are
+	// kept for inspection.
+	CorruptFileNamePrefix = "corrupt."
+)
+
+var (
+	ErrInvalidEntryType = errors.New("invalid log entry type")
+	// ErrLogFileHeaderLost is returned by Repair for an encrypted log file
+	// whose header is broken, the entries can not be decrypted without it.
+	ErrLogFileHeaderLost = errors.New("header of encrypted log file lost")
+)
+
+type (
+	// CorruptRange is a range of a log file from which no entry can be decoded,
+	// Err is why the entry at Offset could not.
+	CorruptRange struct {
+		Offset int64
+		End    int64
+		Err    error
+	}
+
+	// FileReport describes a log file checked by Verify.
+	FileReport struct {
+		FID     int
+		Path    string
+		Size    int64
+		Entries int
+		Corrupt []CorruptRange
+	}
+)
+
+func (r CorruptRange) String() string {
+	return fmt.Sprintf("[%d, %d): %v", r.Offset, r.End, r.Err)
+}
+
+// Corrupted reports whether the log file has corrupt ranges.
+func (r FileReport) Corrupted() bool {
+	return len(r.Corrupt) > 0
+}
+
+// Verify decodes every entry of the log files of dbPath, checking their crc,
+// header and type, and reports the ranges of each file which hold no valid
+// entry. A broken header is reported as a corrupt range at offset 0. The
+// encrypted entries are checked without being decrypted, no key is needed. After a corrupt range the check goes on at the next offset where a
+// valid entry starts. The db may be open meanwhile, the tail being written
+// to the active log file may then be reported as corrupt.
+func Verify(dbPath string) ([]FileReport, error) {
+	fids, err := listLogFiles(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]FileReport, 0, len(fids))
+	for _, fid := range fids {
+		lf, headerErr, err := openLogFileToCheck(logFilePath(dbPath, fid), fid)
+		if err != nil {
+			return nil, err
+		}
+
+		report, err := walkLogFile(lf, func([]byte, LogEntryType, bool) error { return nil })
+		lf.Close()
+		if err != nil {
+			return nil, err
+		}
+		if headerErr != nil {
+			cr := CorruptRange{Offset: 0, End: lf.HeaderSize(), Err: headerErr.Err}
+			if report.Size < cr.End {
+				cr.End = report.Size
+			}
+			report.Corrupt = append([]CorruptRange{cr}, report.Corrupt...)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// Repair rewrites the corrupted log files of dbPath with the entries which
+// can still be decoded, see Verify. The entries of a batch broken by a corrupt
+// range are kept as single entries. A broken header is rebuilt, unless the file
+// is encrypted and its header can not be recovered, which fails with
+// ErrLogFileHeaderLost. A corrupted file is replaced atomically,
+// the former one is kept as corrupt.N, and its hint file is removed. The db
+// must not be open, not even read-only. The reports of the files before the
+// repair are returned.
+func Repair(dbPath string) ([]FileReport, error) {
+	for _, name := range []string{LockFileName, ReadLockFileName} {
+		fl := NewFlock(filepath.Join(dbPath, name))
+		if err := fl.TryLock(); err != nil {
+			return nil, err
+		}
+		defer fl.ULock()
+	}
+
+	reports, err := Verify(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, report := range reports {
+		if !report.Corrupted() {
+			continue
+		}
+		if err := repairLogFile(dbPath, report.FID); err != nil {
+			return nil, err
+		}
+	}
+
+	return reports, syncDir(dbPath)
+}
+
+func repairLogFile(dbPath string, fid int) error {
+	lf, headerErr, err := openLogFileToCheck(logFilePath(dbPath, fid), fid)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	repairPath := filepath.Join(dbPath, fmt.Sprintf("%s%d", RepairFileNamePrefix, fid))
+	out, err := openLogFile(repairPath, fid, os.O_CREATE|os.O_TRUNC|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+
+	// the entries are copied as they are, encrypted ones included, after a
+	// header written with the time of the repair, which tells the repaired
+	// file apart from the former one in the backups. A header broken in its
+	// magic only is recovered, any other is rebuilt once the entries are
+	// copied, as is the missing header of a file written before it existed.
+	var header []byte
+	if headerErr == nil || lf.recoverHeader() {
+		if lf.version > 0 {
+			header = encodeLogFileHeader(lf.flags, time.Now().UnixNano(), lf.keyID, lf.codec.noncePrefix)
+		}
+	}
+
+	var (
+		offset  = int64(logFileHeaderSize)
+		pending [][]byte
+		inBatch bool
+		damaged bool
+		// flags are the ones of the entries copied, for a rebuilt header
+		flags uint16
+	)
+	write := func(raws ...[]byte) error {
+		for _, raw := range raws {
+			size, err := out.writeAt(raw, offset)
+			if err != nil {
+				return err
+			}
+			offset += int64(size)
+		}
+		return nil
+	}
+	// a batch broken by a corrupt range loses its markers, one never
+	// committed is dropped like on reload
+	endBatch := func(committed bool) error {
+		defer func() { inBatch, damaged, pending = false, false, nil }()
+		switch {
+		case damaged:
+			return write(pending[1:]...)
+		case committed:
+			return write(pending...)
+		default:
+			return nil
+		}
+	}
+
+	if _, err = walkLogFile(lf, func(raw []byte, typ LogEntryType, resynced bool) error {
+		if raw[4]&entryEncrypted != 0 {
+			flags |= LogFileEncrypted
+		}
+		if raw[4]>>compressionShift&compressionMask != 0 {
+			flags |= LogFileCompressed
+		}
+		damaged = damaged || (inBatch && resynced)
+		switch {
+		case typ == BatchBegin:
+			if inBatch {
+				if err := endBatch(false); err != nil {
+					return err
+				}
+			}
+			inBatch, pending = true, [][]byte{raw}
+		case typ == BatchCommit:
+			if !inBatch {
+				return nil
+			}
+			if !damaged {
+				pending = append(pending, raw)
+			}
+			return endBatch(true)
+		case inBatch:
+			pending = append(pending, raw)
+		default:
+			return write(raw)
+		}
+		return nil
+	}); err == nil && inBatch {
+		err = endBatch(false)
+	}
+	if err == nil && header == nil {
+		if flags&LogFileEncrypted != 0 {
+			err = &CorruptedError{Path: lf.Path(), Offset: 0, Err: ErrLogFileHeaderLost}
+		} else {
+			header = encodeLogFileHeader(flags, time.Now().UnixNano(), 0, nil)
+		}
+	}
+	if err == nil {
+		_, err = out.writeAt(header, 0)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(repairPath)
+		return err
+	}
+
+	// the log file is never missing, even after a crash
+	corruptPath := filepath.Join(dbPath, fmt.Sprintf("%s%d", CorruptFileNamePrefix, fid))
+	if err := os.Remove(corruptPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(lf.Path(), corruptPath); err != nil {
+		return err
+	}
+	if err := os.Rename(repairPath, lf.Path()); err != nil {
+		return err
+	}
+
+	return removeHintFile(dbPath, fid)
+}
+
+// openLogFileToCheck opens a log file read-only for Verify and Repair. A broken
+// header is returned along with the file, whose entries are read after it.
+func openLogFileToCheck(path string, fid int) (*LogFile, *CorruptedError, error) {
+	lf, err := openLogFile(path, fid, os.O_RDONLY)
+	var headerErr *CorruptedError
+	if !errors.As(err, &headerErr) {
+		return lf, nil, err
+	}
+
+	lf, err = openFile(path, fid, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, err
+	}
+	lf.start = int64(logFileHeaderSize)
+	return lf, headerErr, nil
+}
+
+// recoverHeader reads the header of a file broken in its magic only, it
+// reports whether it could.
+func (f *LogFile) recoverHeader() bool {
+	buf := make([]byte, logFileHeaderSize)
+	if _, err := f.file.ReadAt(buf, 0); err != nil {
+		return false
+	}
+	copy(buf, logFileMagic)
+	return f.parseHeader(buf) == nil
+}
+
+// walkLogFile calls fn for every valid entry of lf with its encoded bytes and
+// its type, resynced tells whether a corrupt range precedes it. The scan goes
+// on after a corrupt range at the next offset where a valid entry starts.
+func walkLogFile(lf *LogFile, fn func(raw []byte, typ LogEntryType, resynced bool) error) (FileReport, error) {
+	size, err := lf.Size()
+	if err != nil {
+		return FileReport{}, err
+	}
+
+	report := FileReport{FID: lf.FID(), Path: lf.Path(), Size: size}
+	for offset, resynced := lf.HeaderSize(), false; offset < size; {
+		raw, typ, err := loadValid(lf, offset)
+		if err == nil {
+			report.Entries++
+			if err := fn(raw, typ, resynced); err != nil {
+				return report, err
+			}
+			offset, resynced = offset+int64(len(raw)), false
+			continue
+		}
+		if !isCorrupted(err) && err != ErrInvalidEntryType {
+			return report, err
+		}
+
+		cr := CorruptRange{Offset: offset, End: size, Err: err}
+		for offset++; offset < size; offset++ {
+			_, _, err := loadValid(lf, offset)
+			if err == nil {
+				cr.End = offset
+				break
+			}
+			if !isCorrupted(err) && err != ErrInvalidEntryType {
+				return report, err
+			}
+		}
+		report.Corrupt = append(report.Corrupt, cr)
+		offset, resynced = cr.End, true
+	}
+
+	return report, nil
+}
+
+// loadValid reads the entry at offset, checking its crc, header and type, an
+// encrypted entry is not decrypted.
+func loadValid(lf *LogFile, offset int64) ([]byte, LogEntryType, error) {
+	raw, err := lf.loadRaw(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := Decode(raw); err != nil && err != ErrWrongEncryptionKey {
+		return nil, 0, err
+	}
+
+	typ := LogEntryType(raw[4] & entryTypeMask)
+	if typ < Normal || typ > BatchCommit {
+		return nil, 0, ErrInvalidEntryType
+	}
+	return raw, typ, nil
+}
@@ -0,0 +1,101 @@
+package peach
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepair(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		if i%10 == 0 {
+			// a batch of two entries
+			b := NewBatch()
+			b.Put(kv, kv)
+			b.Put(append(kv, 'b'), kv)
+			assert.Nil(t, db.Write(b))
+		} else {
+			assert.Nil(t, db.Put(kv, kv))
+		}
+		kvs = append(kvs, kv)
+	}
+	archivedPath := db.archivedLogFile[1].Path()
+	assert.Nil(t, db.Close())
+
+	reports, err := Verify(dbPath)
+	assert.Nil(t, err)
+	for _, report := range reports {
+		assert.False(t, report.Corrupted())
+	}
+
+	// damage a few entries in the middle of a sealed log file
+	f, err := os.OpenFile(archivedPath, os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1000)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0x00, 0x00, 0x00}, 5000)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, removeHintFile(dbPath, 1))
+
+	_, err = New(opts)
+	var corrupted *CorruptedError
+	assert.True(t, errors.As(err, &corrupted))
+
+	reports, err = Verify(dbPath)
+	assert.Nil(t, err)
+	for _, report := range reports {
+		if report.Path != archivedPath {
+			assert.False(t, report.Corrupted())
+			continue
+		}
+		assert.Equal(t, 2, len(report.Corrupt))
+		assert.True(t, report.Corrupt[0].Offset <= 1000 && report.Corrupt[0].End > 1000)
+		assert.True(t, report.Corrupt[1].Offset <= 5000 && report.Corrupt[1].End > 5000)
+	}
+
+	_, err = Repair(dbPath)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dbPath, CorruptFileNamePrefix+"1"))
+	assert.Nil(t, err)
+
+	reports, err = Verify(dbPath)
+	assert.Nil(t, err)
+	for _, report := range reports {
+		assert.False(t, report.Corrupted())
+	}
+
+	db, err = New(opts)
+	assert.Nil(t, err)
+	lost := 0
+	for _, kv := range kvs {
+		value, err := db.Get(kv)
+		if err == ErrKeyNotFound {
+			lost++
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(kv, value))
+	}
+	assert.True(t, lost > 0 && lost <= 4)
+
+	// the repair can not run on an open db
+	_, err = Repair(dbPath)
+	assert.NotNil(t, err)
+	assert.Nil(t, db.Close())
+}
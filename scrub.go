@@ -0,0 +1,96 @@
+package peach
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Scrub reads every entry of the sealed log files, checking their crc, at
+// the rate of Options.ScrubBytesPerSecond. Each corrupt range found is passed
+// to Options.OnCorruption and counted in Stats.ScrubCorruptions. When ctx is
+// done the scrub stops and ctx.Err() is returned.
+func (db *DB) Scrub(ctx context.Context) error {
+	db.scrubMu.Lock()
+	defer db.scrubMu.Unlock()
+
+	files, err := db.pinSealed()
+	if err != nil {
+		return err
+	}
+
+	for _, lf := range files {
+		if err == nil {
+			err = db.scrubFile(ctx, lf)
+		}
+
+		db.mu.Lock()
+		db.unpin(lf)
+		db.mu.Unlock()
+	}
+
+	return err
+}
+
+// pinSealed returns the archived log files in order, pinned so that a merge
+// does not close them while they are scrubbed.
+func (db *DB) pinSealed() ([]*LogFile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	files := make([]*LogFile, 0, len(db.archivedLogFile))
+	for _, lf := range db.archivedLogFile {
+		lf.pins++
+		files = append(files, lf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FID() < files[j].FID()
+	})
+
+	return files, nil
+}
+
+func (db *DB) scrubFile(ctx context.Context, lf *LogFile) error {
+	report, err := walkLogFile(lf, func(raw []byte, _ LogEntryType, _ bool) error {
+		atomic.AddInt64(&db.scrubbedBytes, int64(len(raw)))
+		return db.scrubLimiter.wait(ctx, db.closeCh, len(raw))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, cr := range report.Corrupt {
+		atomic.AddInt64(&db.scrubCorruptions, 1)
+
+		err := &CorruptedError{Path: lf.Path(), Offset: cr.Offset, Err: cr.Err}
+		log.Printf("scrub found a corrupt range %v in %v", cr, lf.Path())
+		if db.opts.OnCorruption != nil {
+			db.opts.OnCorruption(err)
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) scrubLoop(interval time.Duration) {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.Scrub(context.Background()); err != nil && err != ErrDBClosed {
+				log.Printf("scrub fail, err msg: %v", err.Error())
+			}
+		}
+	}
+}
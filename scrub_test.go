@@ -0,0 +1,74 @@
+package peach
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrub(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 10 << 10
+	opts.CompactionTrigger = 0
+	opts.ScrubBytesPerSecond = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+	}
+
+	assert.Nil(t, db.Scrub(context.Background()))
+	stats := db.Stats()
+	assert.Equal(t, int64(0), stats.ScrubCorruptions)
+	// the headers are not scrubbed
+	sealed := int64(len(stats.Files) - 1)
+	assert.Equal(t, stats.TotalBytes-stats.Files[sealed].Size-sealed*int64(logFileHeaderSize), stats.ScrubbedBytes)
+	archivedPath := db.archivedLogFile[1].Path()
+	assert.Nil(t, db.Close())
+
+	// bit rot in a sealed log file, found by the background scrub
+	f, err := os.OpenFile(archivedPath, os.O_WRONLY, os.ModePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 1000)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	found := make(chan *CorruptedError, 1)
+	opts.ScrubInterval = 10 * time.Millisecond
+	opts.OnCorruption = func(err *CorruptedError) {
+		select {
+		case found <- err:
+		default:
+		}
+	}
+	db, err = New(opts)
+	assert.Nil(t, err)
+
+	select {
+	case err := <-found:
+		assert.Equal(t, archivedPath, err.Path)
+		assert.True(t, err.Offset <= 1000)
+	case <-time.After(5 * time.Second):
+		t.Fatal("corruption not found")
+	}
+	assert.True(t, db.Stats().ScrubCorruptions > 0)
+	assert.Nil(t, db.Close())
+
+	// a slow scrub gives up with ctx
+	opts.ScrubInterval = 0
+	opts.ScrubBytesPerSecond = 1 << 10
+	db, err = New(opts)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, db.Scrub(ctx))
+	cancel()
+	assert.Nil(t, db.Close())
+}
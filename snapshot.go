@@ -0,0 +1,279 @@
+package peach
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/muyisensen/peach/index"
+	"github.com/muyisensen/peach/index/art"
+)
+
+var (
+	ErrSnapshotReleased = errors.New("snapshot is released")
+
+	// snapshotArtOpt sizes the node pool of the keys of an overlay, smaller
+	// than the one of the index since most overlays are small.
+	snapshotArtOpt = &index.AdaptiveRadixTreeOptions{
+		NodeLeafPoolSize: 64,
+		Node4PoolSize:    32,
+		Node16PoolSize:   16,
+		Node48PoolSize:   8,
+		Node256PoolSize:  8,
+	}
+	// overlayMarker is the value of every key of an overlay tree, the values
+	// are in the overlay map.
+	overlayMarker = &index.MemValue{}
+)
+
+type (
+	// Snapshot is a read-only view of DB at the time it was taken. Writes made
+	// since then save the values they replace into the snapshot, which reads
+	// them instead of the current ones. Release must be called once done.
+	Snapshot struct {
+		db *DB
+		// overlay holds the keys changed since the snapshot was taken with
+		// their value at that time, nil for a key which did not exist
+		overlay map[string]*snapshotValue
+		// keys orders the keys of overlay, it is created with the first one
+		keys index.MemTable
+		// pinned are the log files of the overlay values, a merge does not
+		// close them before the snapshot is released
+		pinned   map[*LogFile]struct{}
+		released bool
+	}
+
+	snapshotValue struct {
+		lf       *LogFile
+		memValue index.MemValue
+	}
+)
+
+// Snapshot returns a snapshot of the current content of db.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	s := &Snapshot{
+		db:      db,
+		overlay: make(map[string]*snapshotValue),
+		pinned:  make(map[*LogFile]struct{}),
+	}
+	db.snapshots[s] = struct{}{}
+
+	return s, nil
+}
+
+// Get returns the value of key at the time of the snapshot.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if s.db.closed {
+		return nil, ErrDBClosed
+	}
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	sv, ok := s.overlay[string(key)]
+	if !ok {
+		le, err := s.db.get(key)
+		if err != nil {
+			return nil, err
+		}
+		return le.Value, nil
+	}
+
+	if sv == nil || sv.memValue.IsExpired(time.Now().Unix()) {
+		return nil, ErrKeyNotFound
+	}
+
+	le, err := sv.lf.Read(sv.memValue.Offset, sv.memValue.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return le.Value, nil
+}
+
+// NewIterator returns an iterator over the snapshot positioned at the first
+// key, Close must be called once done but it does not release the snapshot.
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	it := &Iterator{snap: s, opts: opts}
+	it.Seek(opts.Prefix)
+	return it
+}
+
+// Scan is DB.Scan over the snapshot.
+func (s *Snapshot) Scan(start, end []byte, fn func(k, v []byte) bool) error {
+	return scan(s.NewIterator(IteratorOptions{}), start, end, fn)
+}
+
+// PrefixScan is DB.PrefixScan over the snapshot.
+func (s *Snapshot) PrefixScan(prefix []byte, fn func(k, v []byte) bool) error {
+	return scan(s.NewIterator(IteratorOptions{Prefix: prefix}), prefix, nil, fn)
+}
+
+// Release drops the saved values and unpins their log files, it is safe to
+// call it more than once.
+func (s *Snapshot) Release() {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if s.released {
+		return
+	}
+
+	s.released = true
+	s.overlay, s.keys = nil, nil
+	delete(db.snapshots, s)
+	for lf := range s.pinned {
+		db.unpin(lf)
+	}
+	s.pinned = nil
+}
+
+// captureSnapshots saves the current value of key into the snapshots which
+// have not seen it change yet, the write lock must be held.
+func (db *DB) captureSnapshots(key []byte) {
+	if len(db.snapshots) == 0 {
+		return
+	}
+
+	var sv *snapshotValue
+	if memValue := db.lookup(key); memValue != nil {
+		sv = &snapshotValue{lf: db.logFile(memValue.FileID), memValue: *memValue}
+	}
+
+	k := string(key)
+	for s := range db.snapshots {
+		if _, ok := s.overlay[k]; ok {
+			continue
+		}
+
+		s.overlay[k] = sv
+		s.insertKey([]byte(k))
+		if sv == nil {
+			continue
+		}
+		if _, ok := s.pinned[sv.lf]; !ok {
+			s.pinned[sv.lf] = struct{}{}
+			sv.lf.pins++
+		}
+	}
+}
+
+func (s *Snapshot) insertKey(key []byte) {
+	if s.keys == nil {
+		s.keys = art.NewAdaptiveRadixTree(snapshotArtOpt)
+	}
+	s.keys.Put(key, overlayMarker)
+}
+
+// chunk returns up to n keys of the snapshot from start on, they start with
+// prefix and have not expired. next is the key the following chunk starts at,
+// nil when there are no more keys. start must not be less than prefix.
+func (s *Snapshot) chunk(start, prefix []byte, n int) (items []iteratorItem, next []byte, err error) {
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, nil, ErrDBClosed
+	}
+	if s.released {
+		return nil, nil, ErrSnapshotReleased
+	}
+
+	var (
+		bound                = &index.IteratorOptions{LowerBound: start}
+		indexIt              = db.index0.Iterate(bound)
+		overlayIt            index.Iterator
+		indexKey, overlayKey []byte
+		indexValue           *index.MemValue
+		now                  = time.Now().Unix()
+	)
+	if s.keys != nil {
+		overlayIt = s.keys.Iterate(bound)
+	}
+	advanceIndex := func() {
+		indexKey, indexValue = nil, nil
+		if indexIt.HasNext() {
+			indexKey, indexValue = indexIt.Next()
+		}
+	}
+	advanceOverlay := func() {
+		overlayKey = nil
+		if overlayIt != nil && overlayIt.HasNext() {
+			overlayKey, _ = overlayIt.Next()
+		}
+	}
+
+	advanceIndex()
+	advanceOverlay()
+	items = make([]iteratorItem, 0, n)
+	for indexKey != nil || overlayKey != nil {
+		var (
+			key   []byte
+			value *index.MemValue
+		)
+		// a key of the overlay hides the same key of the index
+		if overlayKey != nil && (indexKey == nil || bytes.Compare(overlayKey, indexKey) <= 0) {
+			key = overlayKey
+			advanceOverlay()
+			if indexKey != nil && bytes.Equal(key, indexKey) {
+				advanceIndex()
+			}
+			sv := s.overlay[string(key)]
+			if sv == nil {
+				continue
+			}
+			value = &sv.memValue
+		} else {
+			key, value = indexKey, indexValue
+			advanceIndex()
+		}
+
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if value.IsExpired(now) {
+			continue
+		}
+		if len(items) == n {
+			return items, append([]byte{}, key...), nil
+		}
+
+		item := iteratorItem{key: append([]byte{}, key...)}
+		if value.ExpiredAt != nil {
+			item.expiredAt = *value.ExpiredAt
+		}
+		items = append(items, item)
+	}
+
+	return items, nil, nil
+}
+
+// retire closes a log file removed by a merge, or leaves it open until the
+// last snapshot pinning it is released. The write lock must be held.
+func (db *DB) retire(lf *LogFile) error {
+	if lf.pins > 0 {
+		db.retiredLogFile[lf] = struct{}{}
+		return nil
+	}
+	return lf.Close()
+}
+
+func (db *DB) unpin(lf *LogFile) {
+	lf.pins--
+	if _, ok := db.retiredLogFile[lf]; ok && lf.pins == 0 {
+		delete(db.retiredLogFile, lf)
+		lf.Close()
+	}
+}
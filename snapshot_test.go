@@ -0,0 +1,178 @@
+package peach
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.CompactionTrigger = 0
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 0, 300)
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		assert.Nil(t, db.Put(key, key))
+		keys = append(keys, key)
+	}
+
+	s, err := db.Snapshot()
+	assert.Nil(t, err)
+
+	// overwrite, delete and add keys, then merge the old values away
+	for i, key := range keys {
+		switch i % 3 {
+		case 0:
+			assert.Nil(t, db.Put(key, []byte("new")))
+		case 1:
+			assert.Nil(t, db.Delete(key))
+		}
+	}
+	assert.Nil(t, db.Put([]byte("key-300"), []byte("new")))
+	assert.Nil(t, db.Compact(context.Background()))
+	assert.True(t, len(db.retiredLogFile) > 0)
+
+	for i, key := range keys {
+		value, err := s.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(key, value))
+
+		value, err = db.Get(key)
+		if i%3 == 1 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else if i%3 == 0 {
+			assert.True(t, reflect.DeepEqual([]byte("new"), value))
+		}
+	}
+	_, err = s.Get([]byte("key-300"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	got := make([][]byte, 0, len(keys))
+	assert.Nil(t, s.Scan(nil, nil, func(k, v []byte) bool {
+		assert.True(t, reflect.DeepEqual(k, v))
+		got = append(got, k)
+		return true
+	}))
+	assert.True(t, reflect.DeepEqual(keys, got))
+
+	got = got[:0]
+	assert.Nil(t, s.PrefixScan([]byte("key-01"), func(k, v []byte) bool {
+		got = append(got, k)
+		return true
+	}))
+	assert.True(t, reflect.DeepEqual(keys[10:20], got))
+
+	it := s.NewIterator(IteratorOptions{})
+	it.Seek([]byte("key-150"))
+	assert.True(t, it.Valid())
+	assert.True(t, reflect.DeepEqual(keys[150], it.Key()))
+	it.Close()
+
+	// the db sees the current keys only
+	got = got[:0]
+	assert.Nil(t, db.Scan(nil, nil, func(k, v []byte) bool {
+		got = append(got, k)
+		return true
+	}))
+	assert.Len(t, got, 201)
+	assert.True(t, sort.SliceIsSorted(got, func(i, j int) bool {
+		return bytes.Compare(got[i], got[j]) < 0
+	}))
+
+	s.Release()
+	s.Release()
+	assert.Len(t, db.retiredLogFile, 0)
+	_, err = s.Get(keys[0])
+	assert.Equal(t, ErrSnapshotReleased, err)
+	assert.Equal(t, ErrSnapshotReleased, s.Scan(nil, nil, func(k, v []byte) bool { return true }))
+	assert.Nil(t, db.Close())
+
+	_, err = db.Snapshot()
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	db, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	n := 2*iteratorChunkSize + 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		assert.Nil(t, db.Put(key, key))
+	}
+
+	s, err := db.Snapshot()
+	assert.Nil(t, err)
+	defer s.Release()
+
+	// writes go on while iterating, across the chunks
+	i := 0
+	it := s.NewIterator(IteratorOptions{})
+	for ; it.Valid(); it.Next() {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		assert.True(t, reflect.DeepEqual(key, it.Key()))
+		value, err := it.Value()
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual(key, value))
+
+		assert.Nil(t, db.Delete(key))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i+iteratorChunkSize)), []byte("new")))
+		assert.Nil(t, db.Put(append(key, '+'), []byte("new")))
+		i++
+	}
+	it.Close()
+	assert.Equal(t, n, i)
+
+	_, err = db.Get([]byte("key-0000"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestSnapshotManyWrites(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	db, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		key := []byte(fmt.Sprintf("key-%06d", i))
+		assert.Nil(t, db.Put(key, key))
+	}
+
+	s, err := db.Snapshot()
+	assert.Nil(t, err)
+	defer s.Release()
+
+	// many keys are saved by the snapshot, they are written out of order
+	n := 100000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%06d", (i*7919)%n))
+		assert.Nil(t, db.Put(key, []byte("new")))
+	}
+	assert.Equal(t, int64(n), db.Size())
+
+	i := 0
+	assert.Nil(t, s.Scan(nil, nil, func(k, v []byte) bool {
+		key := []byte(fmt.Sprintf("key-%06d", i))
+		assert.True(t, reflect.DeepEqual(key, k))
+		assert.True(t, reflect.DeepEqual(key, v))
+		i += 2
+		return true
+	}))
+	assert.Equal(t, 1000, i)
+}
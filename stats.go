@@ -0,0 +1,98 @@
+package peach
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+type (
+	// FileStats describes the space usage of one log file.
+	FileStats struct {
+		FID       int
+		Size      int64
+		LiveBytes int64
+		DeadBytes int64
+		Actived   bool
+	}
+
+	Stats struct {
+		Keys       int64
+		TotalBytes int64
+		LiveBytes  int64
+		DeadBytes  int64
+		InGc       bool
+		// ScrubbedBytes is the number of bytes read by the scrubs so far and
+		// ScrubCorruptions the number of corrupt ranges they found.
+		ScrubbedBytes    int64
+		ScrubCorruptions int64
+		// Files is sorted by file id, the active log file is the last one.
+		Files []FileStats
+	}
+)
+
+// GarbageRatio returns the ratio of dead bytes to the size of the file.
+func (fs FileStats) GarbageRatio() float64 {
+	if fs.Size == 0 {
+		return 0
+	}
+	return float64(fs.DeadBytes) / float64(fs.Size)
+}
+
+// GarbageRatio returns the ratio of dead bytes to the size of all log files.
+func (s Stats) GarbageRatio() float64 {
+	if s.TotalBytes == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(s.TotalBytes)
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		Keys:             db.size,
+		InGc:             db.inGc,
+		ScrubbedBytes:    atomic.LoadInt64(&db.scrubbedBytes),
+		ScrubCorruptions: atomic.LoadInt64(&db.scrubCorruptions),
+		Files:            db.fileStats(),
+	}
+	for _, fs := range stats.Files {
+		stats.TotalBytes += fs.Size
+		stats.LiveBytes += fs.LiveBytes
+		stats.DeadBytes += fs.DeadBytes
+	}
+
+	return stats
+}
+
+// fileStats returns the stats of every log file, the read lock must be held.
+func (db *DB) fileStats() []FileStats {
+	files := make([]FileStats, 0, len(db.archivedLogFile)+1)
+	for _, lf := range db.archivedLogFile {
+		files = append(files, newFileStats(lf))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FID < files[j].FID
+	})
+
+	if db.activedLogFile != nil {
+		fs := newFileStats(db.activedLogFile)
+		fs.Actived = true
+		files = append(files, fs)
+	}
+
+	return files
+}
+
+func newFileStats(lf *LogFile) FileStats {
+	size, _ := lf.Size()
+	live := lf.LiveBytes()
+	return FileStats{
+		FID:       lf.FID(),
+		Size:      size,
+		LiveBytes: live,
+		// the header is neither
+		DeadBytes: size - lf.HeaderSize() - live,
+	}
+}
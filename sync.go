@@ -0,0 +1,158 @@
+package peach
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	syncMode uint8
+
+	// SyncPolicy is one of SyncNone, SyncAlways or SyncEveryInterval.
+	SyncPolicy struct {
+		mode     syncMode
+		interval time.Duration
+	}
+
+	// syncer implements group commit: writers waiting for durability share a
+	// single fsync of the active log file. The first waiter becomes the leader
+	// and syncs every write made so far, the others wait for it.
+	syncer struct {
+		db      *DB
+		mu      sync.Mutex
+		cond    *sync.Cond
+		syncing bool
+		synced  uint64
+		fsyncs  uint64
+	}
+)
+
+const (
+	syncNone syncMode = iota
+	syncAlways
+	syncEveryInterval
+)
+
+var (
+	// SyncNone leaves flushing to the operating system.
+	SyncNone = SyncPolicy{mode: syncNone}
+	// SyncAlways makes every write durable before it returns.
+	SyncAlways = SyncPolicy{mode: syncAlways}
+)
+
+// SyncEveryInterval flushes the writes in the background every interval.
+func SyncEveryInterval(interval time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncEveryInterval, interval: interval}
+}
+
+func newSyncer(db *DB) *syncer {
+	s := &syncer{db: db}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// wait returns once the write numbered seq is on stable storage.
+func (s *syncer) wait(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.synced < seq {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+
+		s.syncing = true
+		s.mu.Unlock()
+		synced, err := s.db.syncActived()
+		s.mu.Lock()
+		s.syncing = false
+		s.fsyncs++
+		s.cond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+		if synced > s.synced {
+			s.synced = synced
+		}
+	}
+
+	return nil
+}
+
+// syncActived syncs the active log file and returns the number of the last
+// write it holds. Writes to former active log files are synced when they are
+// sealed by switchActivedLogFile, the ones whose sync failed then are synced
+// again first.
+func (db *DB) syncActived() (uint64, error) {
+	db.mu.RLock()
+	lf, seq, unsynced := db.activedLogFile, db.writeSeq, db.unsynced
+	db.mu.RUnlock()
+
+	for _, sealed := range unsynced {
+		if err := sealed.Sync(); err != nil && db.isArchived(sealed) {
+			return 0, err
+		}
+	}
+	if err := lf.Sync(); err != nil {
+		return 0, err
+	}
+
+	if len(unsynced) > 0 {
+		db.mu.Lock()
+		db.unsynced = db.unsynced[len(unsynced):]
+		db.mu.Unlock()
+	}
+	return seq, nil
+}
+
+// isArchived reports whether lf is still a sealed log file of db, a merge
+// may have replaced it meanwhile.
+func (db *DB) isArchived(lf *LogFile) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.archivedLogFile[lf.FID()] == lf
+}
+
+// update runs fn under the write lock, then waits for its writes to be
+// durable as required by the sync policy. The lock is released before
+// syncing so that concurrent writers share one fsync.
+func (db *DB) update(fn func() error) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	if db.opts.ReadOnly {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+	err := fn()
+	seq := db.writeSeq
+	db.mu.Unlock()
+
+	if err != nil || db.opts.SyncPolicy.mode != syncAlways {
+		return err
+	}
+
+	return db.syncer.wait(seq)
+}
+
+func (db *DB) syncLoop(interval time.Duration) {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.Sync(); err != nil {
+				log.Printf("sync fail, err msg: %v", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package peach
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muyisensen/peach/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncAlways(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.SyncPolicy = SyncAlways
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kvs := make([][]byte, 0, 800)
+	for i := 0; i < 800; i++ {
+		kvs = append(kvs, utils.RandBytes(36))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(kvs [][]byte) {
+			defer wg.Done()
+			for _, kv := range kvs {
+				assert.Nil(t, db.Put(kv, kv))
+			}
+		}(kvs[i*100 : (i+1)*100])
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(800), db.writeSeq)
+	assert.Equal(t, db.writeSeq, db.syncer.synced)
+
+	// the writers waiting together share one fsync
+	fsyncs := db.syncer.fsyncs
+	for round := 0; round < 10; round++ {
+		db.syncer.mu.Lock()
+		seq := db.writeSeq
+		for _, kv := range kvs[round*8 : (round+1)*8] {
+			wg.Add(1)
+			go func(kv []byte) {
+				defer wg.Done()
+				assert.Nil(t, db.Put(kv, kv))
+			}(kv)
+		}
+		for {
+			db.mu.RLock()
+			written := db.writeSeq == seq+8
+			db.mu.RUnlock()
+			if written {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		db.syncer.mu.Unlock()
+		wg.Wait()
+	}
+	assert.Equal(t, fsyncs+10, db.syncer.fsyncs)
+	assert.Nil(t, db.Close())
+}
+
+func TestSyncAlwaysSealFailure(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.SyncPolicy = SyncAlways
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	kv := utils.RandBytes(36)
+	assert.Nil(t, db.Put(kv, kv))
+
+	// the sync of the sealed log file fails
+	sealed := db.activedLogFile
+	file := sealed.file
+	closed, err := os.Open(sealed.Path())
+	assert.Nil(t, err)
+	assert.Nil(t, closed.Close())
+	sealed.file = closed
+	db.mu.Lock()
+	assert.NotNil(t, db.switchActivedLogFile())
+	db.mu.Unlock()
+
+	// no later write is reported durable before the sealed file is synced
+	assert.NotNil(t, db.Put(kv, kv))
+	assert.NotNil(t, db.Sync())
+	assert.Len(t, db.unsynced, 1)
+
+	sealed.file = file
+	assert.Nil(t, db.Put(kv, kv))
+	assert.Len(t, db.unsynced, 0)
+	assert.Nil(t, db.Close())
+}
+
+func TestSyncEveryInterval(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	opts := DefaultOptions(dbPath)
+	opts.SyncPolicy = SyncEveryInterval(10 * time.Millisecond)
+	db, err := New(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		kv := utils.RandBytes(36)
+		assert.Nil(t, db.Put(kv, kv))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	db.syncer.mu.Lock()
+	assert.Equal(t, uint64(100), db.syncer.synced)
+	db.syncer.mu.Unlock()
+	assert.Nil(t, db.Close())
+}
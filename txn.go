@@ -0,0 +1,144 @@
+package peach
+
+import (
+	"errors"
+	"time"
+
+	"github.com/muyisensen/peach/index"
+)
+
+var (
+	ErrConflict    = errors.New("transaction conflict, key read has been modified")
+	ErrTxnReadOnly = errors.New("transaction is read-only")
+	ErrTxnDone     = errors.New("transaction has been committed or discarded")
+)
+
+type (
+	// Txn is an optimistic transaction. Writes are buffered until commit, reads
+	// are recorded and validated at commit: if any key read has been modified by
+	// another writer in the meanwhile, commit fails with ErrConflict.
+	//
+	// A key's version is the identity of its index.MemValue, every write
+	// allocates a new one while gc only relocates the existing one.
+	Txn struct {
+		db       *DB
+		writable bool
+		done     bool
+		reads    map[string]*index.MemValue
+		pending  map[string]*LogEntry
+		entries  []*LogEntry
+		// snap is the snapshot read by a read-only transaction
+		snap *Snapshot
+	}
+)
+
+// Update runs fn in a read-write transaction and commits it if fn returns nil.
+func (db *DB) Update(fn func(tx *Txn) error) error {
+	tx := &Txn{
+		db:       db,
+		writable: true,
+		reads:    make(map[string]*index.MemValue),
+		pending:  make(map[string]*LogEntry),
+	}
+	defer func() { tx.done = true }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+// View runs fn in a read-only transaction, it reads from a snapshot so that
+// every read sees the same state while writes go on.
+func (db *DB) View(fn func(tx *Txn) error) error {
+	s, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+
+	tx := &Txn{db: db, snap: s}
+	defer func() { tx.done = true }()
+
+	return fn(tx)
+}
+
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+
+	if !tx.writable {
+		return tx.snap.Get(key)
+	}
+
+	if le, ok := tx.pending[string(key)]; ok {
+		if le.Type == Delete || (le.Type == ExpiredAt && le.Timestamp <= time.Now().Unix()) {
+			return nil, ErrKeyNotFound
+		}
+		return le.Value, nil
+	}
+
+	tx.db.mu.RLock()
+	defer tx.db.mu.RUnlock()
+
+	if tx.db.closed {
+		return nil, ErrDBClosed
+	}
+
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = tx.db.lookup(key)
+	}
+
+	le, err := tx.db.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return le.Value, nil
+}
+
+func (tx *Txn) Put(key, value []byte) error {
+	return tx.append(Normal, time.Now().Unix(), key, value)
+}
+
+func (tx *Txn) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return tx.append(ExpiredAt, expireTime(ttl), key, value)
+}
+
+func (tx *Txn) Delete(key []byte) error {
+	return tx.append(Delete, time.Now().Unix(), key, nil)
+}
+
+func (tx *Txn) append(typ LogEntryType, timestamp int64, key, value []byte) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	if !tx.writable {
+		return ErrTxnReadOnly
+	}
+
+	le := newLogEntry(typ, timestamp, key, value)
+	tx.pending[string(le.Key)] = le
+	tx.entries = append(tx.entries, le)
+
+	return nil
+}
+
+func (tx *Txn) commit() error {
+	if len(tx.entries) == 0 {
+		return nil
+	}
+
+	db := tx.db
+	return db.update(func() error {
+		for key, memValue := range tx.reads {
+			if db.lookup([]byte(key)) != memValue {
+				return ErrConflict
+			}
+		}
+
+		return db.writeBatch(tx.entries)
+	})
+}
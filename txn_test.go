@@ -0,0 +1,101 @@
+package peach
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	dbPath := "/tmp/peach"
+	os.RemoveAll(dbPath)
+	db, err := New(DefaultOptions(dbPath))
+	assert.Nil(t, err)
+
+	k1, k2 := []byte("k1"), []byte("k2")
+	assert.Nil(t, db.Put(k1, []byte("v1")))
+
+	err = db.Update(func(tx *Txn) error {
+		value, err := tx.Get(k1)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(k2, value); err != nil {
+			return err
+		}
+		if err := tx.Delete(k1); err != nil {
+			return err
+		}
+
+		_, err = tx.Get(k1)
+		assert.Equal(t, ErrKeyNotFound, err)
+		value, err = tx.Get(k2)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual([]byte("v1"), value))
+
+		// not visible outside of the transaction before commit
+		_, err = db.Get(k2)
+		assert.Equal(t, ErrKeyNotFound, err)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	err = db.View(func(tx *Txn) error {
+		_, err := tx.Get(k1)
+		assert.Equal(t, ErrKeyNotFound, err)
+		value, err := tx.Get(k2)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual([]byte("v1"), value))
+		assert.Equal(t, ErrTxnReadOnly, tx.Put(k1, value))
+
+		// writes go on but are not visible in the transaction
+		k3 := []byte("k3")
+		assert.Nil(t, db.Put(k3, []byte("v3")))
+		_, err = tx.Get(k3)
+		assert.Equal(t, ErrKeyNotFound, err)
+		value, err = db.Get(k3)
+		assert.Nil(t, err)
+		assert.True(t, reflect.DeepEqual([]byte("v3"), value))
+		return db.Delete(k3)
+	})
+	assert.Nil(t, err)
+
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx *Txn) error {
+		assert.Nil(t, tx.Put(k1, []byte("aborted")))
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+	_, err = db.Get(k1)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Update(func(tx *Txn) error {
+		if _, err := tx.Get(k2); err != nil {
+			return err
+		}
+		// another writer modifies the key read by the transaction
+		assert.Nil(t, db.Put(k2, []byte("v2")))
+		return tx.Put(k1, []byte("v1"))
+	})
+	assert.Equal(t, ErrConflict, err)
+	_, err = db.Get(k1)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Update(func(tx *Txn) error {
+		// a key which did not exist when read is also checked
+		_, err := tx.Get(k1)
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Put(k1, []byte("v1")))
+		return tx.Put(k1, []byte("v3"))
+	})
+	assert.Equal(t, ErrConflict, err)
+
+	value, err := db.Get(k1)
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual([]byte("v1"), value))
+	assert.Equal(t, int64(2), db.Size())
+	assert.Nil(t, db.Close())
+}